@@ -5,22 +5,65 @@ import (
 	"net/http"
 	"time"
 
+	joonix "github.com/joonix/log"
 	log "github.com/sirupsen/logrus"
 	"github.com/urfave/cli"
 	cs "github.com/webtor-io/common-services"
 	s "github.com/webtor-io/transcode-web-cache/services"
 )
 
+const (
+	logFormatFlag = "log-format"
+)
+
 func configure(app *cli.App) {
-	app.Flags = []cli.Flag{}
+	app.Flags = []cli.Flag{
+		cli.StringFlag{
+			Name:   logFormatFlag,
+			Usage:  "log format (text, json)",
+			Value:  "text",
+			EnvVar: "LOG_FORMAT",
+		},
+	}
 	cs.RegisterProbeFlags(app)
 	cs.RegisterS3ClientFlags(app)
 	s.RegisterS3StorageFlags(app)
+	s.RegisterS3RetrierFlags(app)
+	s.RegisterDonePoolFlags(app)
+	s.RegisterTouchPoolFlags(app)
+	s.RegisterTouchSinkFlags(app)
+	cs.RegisterRedisClientFlags(app)
 	s.RegisterWebFlags(app)
+	s.RegisterBlockCacheFlags(app)
+	s.RegisterLookaheadCacheFlags(app)
+	s.RegisterPrewarmerFlags(app)
+	s.RegisterTracerFlags(app)
+	s.RegisterThrottlerFlags(app)
+	s.RegisterRateLimiterFlags(app)
+	s.RegisterCORSFlags(app)
+	s.RegisterOriginProxyFlags(app)
+	s.RegisterTranscodeTriggerFlags(app)
+	s.RegisterContentTypesFlags(app)
+	s.RegisterSegmentURLFlags(app)
+	s.RegisterSubtitleConverterFlags(app)
+	s.RegisterByteRangePlaylistFlags(app)
+	s.RegisterIFramePlaylistFlags(app)
 	app.Action = run
 }
 
 func run(c *cli.Context) error {
+	// Setting log format
+	if c.String(logFormatFlag) == "json" {
+		log.SetFormatter(joonix.NewFormatter())
+	}
+
+	// Setting Tracer
+	tr, err := s.NewTracer(c)
+	if err != nil {
+		return err
+	}
+	defer tr.Close()
+
 	// Setting HTTP Client
 	myTransport := &http.Transport{
 		MaxIdleConns:        500,
@@ -31,40 +74,112 @@ func run(c *cli.Context) error {
 	}
 	cl := &http.Client{
 		Timeout:   5 * time.Minute,
-		Transport: myTransport,
+		Transport: tr.Transport(myTransport),
 	}
 
 	// Setting S3 Client
 	s3cl := cs.NewS3Client(c, cl)
 
+	// Setting S3 Retrier
+	s3r := s.NewS3Retrier(c)
+
 	// Setting S3 Storage
-	s3st := s.NewS3Storage(c, s3cl)
+	s3st := s.NewS3Storage(c, s3cl, s3r)
+
+	// Setting Redis Client
+	var rcl *cs.RedisClient
+	if s.UseRedisTouchSink(c) {
+		rcl = cs.NewRedisClient(c)
+		defer rcl.Close()
+	}
+
+	// Setting TouchSink
+	ts, err := s.NewTouchSink(c, s3st, rcl)
+	if err != nil {
+		return err
+	}
 
 	// Setting TouchPool
-	tp := s.NewTouchPool(s3st)
+	tp := s.NewTouchPool(c, ts)
+	defer tp.Close()
 
 	// Setting DonePool
-	dp := s.NewDonePool(s3st)
+	dp := s.NewDonePool(c, s3st)
 
 	// Setting Cache
-	cache := s.NewCache(s3st, dp)
+	cache := s.NewCache(s3st, dp, tr)
 
-	// Setting LookaheadCache
-	lacache := s.NewLookaheadCache(cache)
+	// Setting ContentInfoCache
+	ci := s.NewContentInfoCache(s3st, dp)
+
+	// Setting Stats
+	st := s.NewStats()
+
+	// Setting ContentCache
+	var ca s.ContentCache
+	if s.UseBlockCache(c) {
+		// Setting BlockCache
+		bc := s.NewBlockCache(c, s3st, dp, ci, tr)
+		err = bc.Init()
+		if err != nil {
+			return err
+		}
+		ca = bc
+	} else {
+		// Setting LookaheadCache
+		ca = s.NewLookaheadCache(c, cache, st)
+	}
+
+	// Setting Prewarmer
+	pw := s.NewPrewarmer(c, st, ca, dp)
+	defer pw.Close()
 
 	// Setting ProbeService
 	probe := cs.NewProbe(c)
 	defer probe.Close()
 
+	// Setting Throttler
+	th := s.NewThrottler(c)
+
+	// Setting RateLimiter
+	rl := s.NewRateLimiter(c, th)
+
+	// Setting OriginProxy
+	or := s.NewOriginProxy(c, cl)
+
+	// Setting TranscodeTrigger
+	tt := s.NewTranscodeTrigger(c, cl)
+
+	// Setting ContentTypes
+	ct, err := s.NewContentTypes(c)
+	if err != nil {
+		return err
+	}
+
+	// Setting SubtitleConverter
+	sc := s.NewSubtitleConverter(c, ca, s3st, dp, tr)
+
+	// Setting ByteRangePlaylist
+	bp := s.NewByteRangePlaylist(c, s3st, ci, dp, tr)
+
+	// Setting IFramePlaylist
+	ip := s.NewIFramePlaylist(c, ca, s3st, ci, bp, dp, tr)
+
+	// Setting CORS
+	cors, err := s.NewCORS(c)
+	if err != nil {
+		return err
+	}
+
 	// Setting WebService
-	web := s.NewWeb(c, lacache, tp, dp)
+	web := s.NewWeb(c, ca, tp, dp, st, th, rl, or, tt, ci, ct, sc, bp, ip, cors, tr)
 	defer web.Close()
 
 	// Setting ServeService
 	serve := cs.NewServe(probe, web)
 
 	// And SERVE!
-	err := serve.Serve()
+	err = serve.Serve()
 	if err != nil {
 		log.WithError(err).Error("Got server error")
 	}
@@ -0,0 +1,70 @@
+package services
+
+import (
+	"context"
+	"crypto/rand"
+	"fmt"
+	"net/http"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+type accessLogContextKey struct{}
+
+// accessLogEntry carries values set by inner handlers
+type accessLogEntry struct {
+	key   string
+	cache CacheStatus
+}
+
+func getAccessLogEntry(r *http.Request) *accessLogEntry {
+	if e, ok := r.Context().Value(accessLogContextKey{}).(*accessLogEntry); ok {
+		return e
+	}
+	return &accessLogEntry{}
+}
+
+func setAccessLogKey(r *http.Request, key string) {
+	getAccessLogEntry(r).key = key
+}
+
+func setAccessLogCacheStatus(r *http.Request, st CacheStatus) {
+	getAccessLogEntry(r).cache = st
+}
+
+func generateRequestID() string {
+	b := make([]byte, 16)
+	_, err := rand.Read(b)
+	if err != nil {
+		return fmt.Sprintf("%x", time.Now().UnixNano())
+	}
+	return fmt.Sprintf("%x", b)
+}
+
+func accessLogHandler(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		id := r.Header.Get("X-Request-ID")
+		if id == "" {
+			id = generateRequestID()
+			r.Header.Set("X-Request-ID", id)
+		}
+		w.Header().Set("X-Request-ID", id)
+		e := &accessLogEntry{}
+		r = r.WithContext(context.WithValue(r.Context(), accessLogContextKey{}, e))
+		cw := NewCountingResponseWriter(w)
+		h.ServeHTTP(cw, r)
+		log.WithFields(log.Fields{
+			"request_id": id,
+			"method":     r.Method,
+			"path":       r.URL.Path,
+			"status":     cw.statusCode,
+			"bytes":      cw.bytes,
+			"duration":   time.Since(start).Seconds(),
+			"key":        e.key,
+			"cache":      string(e.cache),
+			"remote":     r.RemoteAddr,
+		}).Info("access")
+	})
+}
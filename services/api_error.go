@@ -0,0 +1,78 @@
+package services
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/pkg/errors"
+)
+
+const (
+	storageRetryAfter    = 5
+	generatingRetryAfter = 5
+)
+
+// Error codes returned in JSON error bodies
+const (
+	ErrCodeInvalidRequest     = "invalid_request"
+	ErrCodeNotDone            = "not_done"
+	ErrCodeTranscoding        = "transcoding"
+	ErrCodeNotFound           = "not_found"
+	ErrCodeGenerating         = "generating"
+	ErrCodeRateLimited        = "rate_limited"
+	ErrCodeTooManyConns       = "too_many_connections"
+	ErrCodeStorageUnavailable = "storage_unavailable"
+	ErrCodeOriginUnavailable  = "origin_unavailable"
+	ErrCodeInternal           = "internal"
+)
+
+// APIError is JSON error body, RetryAfter is a hint in seconds
+// when request is worth retrying
+type APIError struct {
+	Code       string `json:"code"`
+	Message    string `json:"message"`
+	Key        string `json:"key,omitempty"`
+	RetryAfter int    `json:"retry_after,omitempty"`
+}
+
+func writeAPIError(w http.ResponseWriter, status int, e *APIError) {
+	b, _ := json.Marshal(e)
+	w.Header().Del("ETag")
+	w.Header().Del("Content-Encoding")
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Content-Length", strconv.Itoa(len(b)))
+	if e.RetryAfter > 0 {
+		w.Header().Set("Retry-After", strconv.Itoa(e.RetryAfter))
+	}
+	w.WriteHeader(status)
+	w.Write(b)
+}
+
+// isStorageError reports whether error is caused by unavailable storage backend
+func isStorageError(err error) bool {
+	if errors.Is(err, ErrCircuitOpen) {
+		return true
+	}
+	var aerr awserr.Error
+	return errors.As(err, &aerr)
+}
+
+// writeServerError writes 503 for storage errors and 500 for anything else
+func writeServerError(w http.ResponseWriter, key string, err error) {
+	if isStorageError(err) {
+		writeAPIError(w, http.StatusServiceUnavailable, &APIError{
+			Code:       ErrCodeStorageUnavailable,
+			Message:    "storage is temporarily unavailable",
+			Key:        key,
+			RetryAfter: storageRetryAfter,
+		})
+		return
+	}
+	writeAPIError(w, http.StatusInternalServerError, &APIError{
+		Code:    ErrCodeInternal,
+		Message: "internal error",
+		Key:     key,
+	})
+}
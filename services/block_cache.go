@@ -0,0 +1,352 @@
+package services
+
+import (
+	"container/list"
+	"context"
+	"crypto/sha1"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"github.com/urfave/cli"
+	"github.com/webtor-io/lazymap"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+const (
+	blockCacheFlag         = "block-cache"
+	blockSizeFlag          = "block-size"
+	blockCacheCapacityFlag = "block-cache-capacity"
+	blockCachePath         = "cache/blocks"
+)
+
+func RegisterBlockCacheFlags(c *cli.App) {
+	c.Flags = append(c.Flags, cli.BoolFlag{
+		Name:   blockCacheFlag,
+		Usage:  "cache fixed-size blocks of objects instead of whole objects",
+		EnvVar: "BLOCK_CACHE",
+	})
+	c.Flags = append(c.Flags, cli.Int64Flag{
+		Name:   blockSizeFlag,
+		Usage:  "block size in bytes",
+		Value:  4 * 1024 * 1024,
+		EnvVar: "BLOCK_SIZE",
+	})
+	c.Flags = append(c.Flags, cli.IntFlag{
+		Name:   blockCacheCapacityFlag,
+		Usage:  "max number of blocks kept on disk",
+		Value:  2000,
+		EnvVar: "BLOCK_CACHE_CAPACITY",
+	})
+}
+
+// BlockCache caches fixed-size blocks of S3 objects independently,
+// so large objects can be served before they are fully downloaded
+type BlockCache struct {
+	s3st     *S3Storage
+	dp       *DonePool
+	path     string
+	bs       int64
+	capacity int
+	mux      sync.Mutex
+	lru      *list.List
+	items    map[string]*list.Element
+	blocks   lazymap.LazyMap
+	infos    *ContentInfoCache
+	tr       *Tracer
+}
+
+func NewBlockCache(c *cli.Context, s3st *S3Storage, dp *DonePool, infos *ContentInfoCache, tr *Tracer) *BlockCache {
+	return &BlockCache{
+		s3st:     s3st,
+		dp:       dp,
+		path:     blockCachePath,
+		bs:       c.Int64(blockSizeFlag),
+		capacity: c.Int(blockCacheCapacityFlag),
+		lru:      list.New(),
+		items:    map[string]*list.Element{},
+		blocks: lazymap.New(&lazymap.Config{
+			Concurrency: 100,
+			Expire:      60 * time.Second,
+			ErrorExpire: 30 * time.Second,
+			Capacity:    1000,
+		}),
+		infos: infos,
+		tr:    tr,
+	}
+}
+
+func UseBlockCache(c *cli.Context) bool {
+	return c.Bool(blockCacheFlag)
+}
+
+// Init restores LRU state from blocks left on disk by a previous run
+func (s *BlockCache) Init() error {
+	err := os.MkdirAll(s.path, 0755)
+	if err != nil {
+		return errors.Wrapf(err, "failed to create block cache dir path=%v", s.path)
+	}
+	entries, err := os.ReadDir(s.path)
+	if err != nil {
+		return errors.Wrapf(err, "failed to read block cache dir path=%v", s.path)
+	}
+	type block struct {
+		name string
+		t    time.Time
+	}
+	bb := []block{}
+	for _, e := range entries {
+		if e.IsDir() {
+			continue
+		}
+		p := filepath.Join(s.path, e.Name())
+		if e.Name()[0] == '_' {
+			os.Remove(p)
+			continue
+		}
+		fi, err := e.Info()
+		if err != nil {
+			continue
+		}
+		bb = append(bb, block{name: e.Name(), t: fi.ModTime()})
+	}
+	sort.Slice(bb, func(i, j int) bool {
+		return bb[i].t.Before(bb[j].t)
+	})
+	for _, b := range bb {
+		s.add(b.name)
+	}
+	log.Infof("block cache restored blocks=%v path=%v", len(bb), s.path)
+	return nil
+}
+
+func (s *BlockCache) makeKey(key string, path string) (string, error) {
+	_, t, err := s.dp.Done(key)
+	if err != nil {
+		return "", errors.Wrapf(err, "failed to get key")
+	}
+	if t == nil {
+		return "", &NotFoundError{errors.Errorf("content is not done key=%v", key)}
+	}
+	return fmt.Sprintf("%x", sha1.Sum([]byte(key+path+t.String()))), nil
+}
+
+func (s *BlockCache) Get(ctx context.Context, key string, path string) (io.ReadSeekCloser, CacheStatus, error) {
+	kk, err := s.makeKey(key, path)
+	if err != nil {
+		return nil, "", err
+	}
+	ci, err := s.infos.Get(ctx, key, path)
+	if err != nil {
+		return nil, "", err
+	}
+	if ci == nil {
+		return nil, CacheStatusMiss, nil
+	}
+	st := CacheStatusMiss
+	s.mux.Lock()
+	if _, ok := s.items[s.blockName(kk, 0)]; ok {
+		st = CacheStatusHit
+	}
+	s.mux.Unlock()
+	return &blockReader{
+		ctx:  ctx,
+		bc:   s,
+		key:  key,
+		path: path,
+		kk:   kk,
+		size: ci.Size,
+		ct:   ci.ContentType,
+	}, st, nil
+}
+
+func (s *BlockCache) blockName(kk string, i int64) string {
+	return fmt.Sprintf("%v-%v", kk, i)
+}
+
+// add registers block in LRU and evicts least recently used blocks over capacity
+func (s *BlockCache) add(name string) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	if e, ok := s.items[name]; ok {
+		s.lru.MoveToBack(e)
+		return
+	}
+	s.items[name] = s.lru.PushBack(name)
+	for s.capacity > 0 && s.lru.Len() > s.capacity {
+		e := s.lru.Front()
+		n := e.Value.(string)
+		s.lru.Remove(e)
+		delete(s.items, n)
+		err := os.Remove(filepath.Join(s.path, n))
+		if err != nil && !os.IsNotExist(err) {
+			log.WithError(err).Warnf("failed to evict block name=%v", n)
+		}
+	}
+}
+
+// touch marks block as recently used, returns false if block is not cached
+func (s *BlockCache) touch(name string) bool {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	e, ok := s.items[name]
+	if !ok {
+		return false
+	}
+	s.lru.MoveToBack(e)
+	return true
+}
+
+// open returns file of i-th block of the object, fetching it on demand
+func (s *BlockCache) open(ctx context.Context, key string, path string, kk string, size int64, i int64) (*os.File, error) {
+	name := s.blockName(kk, i)
+	p := filepath.Join(s.path, name)
+	if s.touch(name) {
+		f, err := os.Open(p)
+		if err == nil {
+			return f, nil
+		}
+		if !os.IsNotExist(err) {
+			return nil, errors.Wrapf(err, "failed to open block path=%v", p)
+		}
+	}
+	_, err := s.blocks.Get(name, func() (interface{}, error) {
+		return nil, s.fetch(ctx, key, path, name, size, i)
+	})
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.Open(p)
+	if os.IsNotExist(err) {
+		// block was evicted after memoized fetch, so fetch it again
+		err = s.fetch(ctx, key, path, name, size, i)
+		if err != nil {
+			return nil, err
+		}
+		f, err = os.Open(p)
+	}
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to open block path=%v", p)
+	}
+	return f, nil
+}
+
+// fetch downloads i-th block of the object to disk unless it is there already
+func (s *BlockCache) fetch(ctx context.Context, key string, path string, name string, size int64, i int64) error {
+	p := filepath.Join(s.path, name)
+	if _, err := os.Stat(p); err == nil {
+		s.add(name)
+		return nil
+	}
+	start := i * s.bs
+	end := start + s.bs - 1
+	if end > size-1 {
+		end = size - 1
+	}
+	ctx, sp := s.tr.Start(context.WithoutCancel(ctx), "block_cache.fetch")
+	defer sp.End()
+	sp.SetAttributes(attribute.Int64("block", i))
+	ctx, cancel := context.WithTimeout(ctx, 60*time.Second)
+	defer cancel()
+	c, err := s.s3st.GetContentRange(ctx, key, path, start, end)
+	if err != nil {
+		return errors.Wrapf(err, "failed to get S3 content range key=%v path=%v", key, path)
+	}
+	if c == nil {
+		return &NotFoundError{}
+	}
+	defer c.Close()
+	f, err := os.CreateTemp(s.path, "_"+name+"-*")
+	if err != nil {
+		return errors.Wrapf(err, "failed to create block file name=%v", name)
+	}
+	tp := f.Name()
+	_, err = io.Copy(f, c)
+	f.Close()
+	if err != nil {
+		setSpanError(sp, err)
+		os.Remove(tp)
+		return errors.Wrapf(err, "failed to copy data path=%v", tp)
+	}
+	err = os.Rename(tp, p)
+	if err != nil {
+		return errors.Wrapf(err, "failed to rename file from=%v to=%v", tp, p)
+	}
+	s.add(name)
+	return nil
+}
+
+// blockReader stitches cached blocks into single object
+type blockReader struct {
+	ctx  context.Context
+	bc   *BlockCache
+	key  string
+	path string
+	kk   string
+	size int64
+	ct   string
+	off  int64
+	cur  int64
+	f    *os.File
+}
+
+func (s *blockReader) Read(p []byte) (int, error) {
+	if s.off >= s.size {
+		return 0, io.EOF
+	}
+	i := s.off / s.bc.bs
+	if s.f == nil || s.cur != i {
+		if s.f != nil {
+			s.f.Close()
+			s.f = nil
+		}
+		f, err := s.bc.open(s.ctx, s.key, s.path, s.kk, s.size, i)
+		if err != nil {
+			return 0, err
+		}
+		s.f = f
+		s.cur = i
+	}
+	n, err := s.f.ReadAt(p, s.off-i*s.bc.bs)
+	s.off += int64(n)
+	if err == io.EOF && n > 0 {
+		err = nil
+	}
+	return n, err
+}
+
+func (s *blockReader) Seek(offset int64, whence int) (int64, error) {
+	var off int64
+	switch whence {
+	case io.SeekStart:
+		off = offset
+	case io.SeekCurrent:
+		off = s.off + offset
+	case io.SeekEnd:
+		off = s.size + offset
+	default:
+		return 0, errors.New("invalid whence")
+	}
+	if off < 0 {
+		return 0, errors.New("negative position")
+	}
+	s.off = off
+	return off, nil
+}
+
+func (s *blockReader) ContentType() string {
+	return s.ct
+}
+
+func (s *blockReader) Close() error {
+	if s.f != nil {
+		return s.f.Close()
+	}
+	return nil
+}
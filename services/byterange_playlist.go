@@ -0,0 +1,130 @@
+package services
+
+import (
+	"context"
+	"crypto/sha1"
+	"fmt"
+	"io"
+	"math"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/urfave/cli"
+)
+
+const (
+	byteRangePlaylistsFlag     = "byterange-playlists"
+	byteRangePlaylistCachePath = "cache/playlists"
+)
+
+var byteRangeSourceExts = []string{".mp4", ".m4v", ".m4a"}
+
+func RegisterByteRangePlaylistFlags(c *cli.App) {
+	c.Flags = append(c.Flags, cli.BoolFlag{
+		Name:   byteRangePlaylistsFlag,
+		Usage:  "generate byte-range HLS media playlists for single-file fragmented MP4 renditions",
+		EnvVar: "BYTERANGE_PLAYLISTS",
+	})
+}
+
+// ByteRangePlaylist generates HLS media playlists with EXT-X-BYTERANGE
+// segments of fragmented MP4 files stored instead of segment files
+type ByteRangePlaylist struct {
+	enabled bool
+	s3st    *S3Storage
+	ci      *ContentInfoCache
+	dp      *DonePool
+	tr      *Tracer
+	files   *GeneratedCache
+}
+
+func NewByteRangePlaylist(c *cli.Context, s3st *S3Storage, ci *ContentInfoCache, dp *DonePool, tr *Tracer) *ByteRangePlaylist {
+	return &ByteRangePlaylist{
+		enabled: c.Bool(byteRangePlaylistsFlag),
+		s3st:    s3st,
+		ci:      ci,
+		dp:      dp,
+		tr:      tr,
+		files:   NewGeneratedCache(byteRangePlaylistCachePath),
+	}
+}
+
+func (s *ByteRangePlaylist) Supports(p string) bool {
+	return s.enabled && strings.HasSuffix(p, ".m3u8")
+}
+
+func (s *ByteRangePlaylist) makeKey(key string, p string) (string, error) {
+	_, t, err := s.dp.Done(key)
+	if err != nil {
+		return "", errors.Wrapf(err, "failed to get key")
+	}
+	if t == nil {
+		return "", &NotFoundError{errors.Errorf("content is not done key=%v", key)}
+	}
+	return fmt.Sprintf("%x", sha1.Sum([]byte(key+p+t.String()))), nil
+}
+
+// Get returns generated playlist, nil if there is no fragmented MP4 with the same name
+func (s *ByteRangePlaylist) Get(ctx context.Context, key string, p string) (io.ReadSeekCloser, error) {
+	kk, err := s.makeKey(key, p)
+	if err != nil {
+		return nil, err
+	}
+	f, err := s.files.Get(kk, func() ([]byte, bool, error) {
+		ctx, sp := s.tr.Start(context.WithoutCancel(ctx), "byterange_playlist.generate")
+		defer sp.End()
+		ctx, cancel := context.WithTimeout(ctx, 60*time.Second)
+		defer cancel()
+		res, ok, err := s.generate(ctx, key, p)
+		setSpanError(sp, err)
+		return []byte(res), ok, err
+	})
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to generate byte-range playlist key=%v path=%v", key, p)
+	}
+	return f, nil
+}
+
+// generate indexes MP4 with ranged reads of its top-level boxes,
+// so media data is never downloaded
+func (s *ByteRangePlaylist) generate(ctx context.Context, key string, p string) (string, bool, error) {
+	base := strings.TrimSuffix(p, ".m3u8")
+	for _, ext := range byteRangeSourceExts {
+		r, err := newS3RangeReader(ctx, s.s3st, s.ci, key, base+ext)
+		if err != nil {
+			return "", false, err
+		}
+		if r == nil {
+			continue
+		}
+		idx, err := parseMP4Index(r)
+		if err != nil {
+			return "", false, errors.Wrapf(err, "failed to index path=%v", base+ext)
+		}
+		return makeByteRangePlaylist(path.Base(base+ext), idx), true, nil
+	}
+	return "", false, nil
+}
+
+func makeByteRangePlaylist(name string, idx *mp4Index) string {
+	td := 0.0
+	for _, f := range idx.fragments {
+		td = math.Max(td, f.duration)
+	}
+	var sb strings.Builder
+	sb.WriteString("#EXTM3U\n")
+	sb.WriteString("#EXT-X-VERSION:7\n")
+	sb.WriteString(fmt.Sprintf("#EXT-X-TARGETDURATION:%v\n", int(math.Ceil(td))))
+	sb.WriteString("#EXT-X-PLAYLIST-TYPE:VOD\n")
+	sb.WriteString("#EXT-X-INDEPENDENT-SEGMENTS\n")
+	sb.WriteString(fmt.Sprintf("#EXT-X-MAP:URI=\"%v\",BYTERANGE=\"%v@0\"\n", name, idx.initSize))
+	for _, f := range idx.fragments {
+		sb.WriteString(fmt.Sprintf("#EXTINF:%.3f,\n", f.duration))
+		sb.WriteString(fmt.Sprintf("#EXT-X-BYTERANGE:%v@%v\n", f.size, f.offset))
+		sb.WriteString(name + "\n")
+	}
+	sb.WriteString("#EXT-X-ENDLIST\n")
+	return sb.String()
+}
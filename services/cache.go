@@ -11,24 +11,42 @@ import (
 	"github.com/pkg/errors"
 	log "github.com/sirupsen/logrus"
 	"github.com/webtor-io/lazymap"
+	"go.opentelemetry.io/otel/attribute"
 )
 
 const (
-	preloadCachePath = "cache"
+	preloadCachePath  = "cache"
+	contentTypeSuffix = ".type"
 )
 
+type CacheStatus string
+
+const (
+	CacheStatusHit        CacheStatus = "hit"
+	CacheStatusMiss       CacheStatus = "miss"
+	CacheStatusPrefetched CacheStatus = "prefetched"
+	CacheStatusProxied    CacheStatus = "proxied"
+)
+
+// ContentCache provides cached object content
+type ContentCache interface {
+	Get(ctx context.Context, key string, path string) (io.ReadSeekCloser, CacheStatus, error)
+}
+
 type Cache struct {
 	lazymap.LazyMap
 	s3st *S3Storage
 	dp   *DonePool
+	tr   *Tracer
 	path string
 }
 
-func NewCache(s3st *S3Storage, dp *DonePool) *Cache {
+func NewCache(s3st *S3Storage, dp *DonePool, tr *Tracer) *Cache {
 	return &Cache{
 		s3st: s3st,
 		path: preloadCachePath,
 		dp:   dp,
+		tr:   tr,
 		LazyMap: lazymap.New(&lazymap.Config{
 			Concurrency: 100,
 			Expire:      60 * time.Second,
@@ -43,73 +61,134 @@ func (s *Cache) makeKey(key string, path string) (string, error) {
 	if err != nil {
 		return "", errors.Wrapf(err, "failed to get key")
 	}
+	if t == nil {
+		return "", &NotFoundError{errors.Errorf("content is not done key=%v", key)}
+	}
 	return fmt.Sprintf("%x", sha1.Sum([]byte(key+path+t.String()))), nil
 }
 
-func (s *Cache) Get(key string, path string) (io.ReadSeekCloser, error) {
+func (s *Cache) Get(ctx context.Context, key string, path string) (io.ReadSeekCloser, CacheStatus, error) {
 	kk, err := s.makeKey(key, path)
 	if err != nil {
-		return nil, err
+		return nil, "", err
 	}
 	fPath := s.path + "/" + kk
-	err = s.Preload(key, path)
+	st, err := s.preload(ctx, key, path, false)
 	if err != nil {
 		if _, ok := err.(*NotFoundError); ok {
-			return nil, nil
+			return nil, st, nil
 		}
-		return nil, errors.Wrapf(err, "failed to preload key=%v path=%v", key, path)
+		return nil, st, errors.Wrapf(err, "failed to preload key=%v path=%v", key, path)
 	}
 	f, err := os.Open(fPath)
 	if err != nil {
-		return nil, err
+		return nil, st, err
 	}
-	return f, nil
+	ct, _ := os.ReadFile(fPath + contentTypeSuffix)
+	return &cachedFile{File: f, ct: string(ct)}, st, nil
+}
+
+// cachedFile is cached object with content type it was stored with
+type cachedFile struct {
+	*os.File
+	ct string
+}
+
+func (s *cachedFile) ContentType() string {
+	return s.ct
 }
 
 type NotFoundError struct {
 	error
 }
 
+type preloadResult struct {
+	prefetch bool
+}
+
+// Preload prefetches content to local cache
 func (s *Cache) Preload(key string, path string) error {
+	_, err := s.preload(context.Background(), key, path, true)
+	return err
+}
+
+func (s *Cache) preload(ctx context.Context, key string, path string, prefetch bool) (st CacheStatus, err error) {
+	ctx, sp := s.tr.Start(ctx, "cache.preload")
+	defer func() {
+		sp.SetAttributes(attribute.String("cache.status", string(st)))
+		setSpanError(sp, err)
+		sp.End()
+	}()
 	kk, err := s.makeKey(key, path)
 	if err != nil {
-		return err
+		return "", err
 	}
-	_, err = s.LazyMap.Get(kk, func() (interface{}, error) {
+	loaded := false
+	existed := false
+	v, err := s.LazyMap.Get(kk, func() (interface{}, error) {
+		loaded = true
+		res := &preloadResult{prefetch: prefetch}
 		p := s.path + "/" + kk
 		tp := s.path + "/_" + kk
 		if _, err := os.Stat(p); os.IsNotExist(err) {
-			ctx, cancel := context.WithTimeout(context.Background(), 60*time.Second)
+			ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), 60*time.Second)
 			defer cancel()
-			c, err := s.s3st.GetContent(ctx, key, path)
+			gctx, gsp := s.tr.Start(ctx, "s3.get_content")
+			c, ci, err := s.s3st.GetContent(gctx, key, path)
+			setSpanError(gsp, err)
+			gsp.End()
 			if err != nil {
 				return nil, errors.Wrapf(err, "failed to get S3 content key=%v path=%v", key, path)
 			}
 			if c == nil {
 				return nil, &NotFoundError{}
 			}
+			defer c.Close()
+			_, csp := s.tr.Start(ctx, "cache.write")
 			f, err := os.Create(tp)
 			if err != nil {
+				setSpanError(csp, err)
+				csp.End()
 				return nil, errors.Wrapf(err, "failed to create preload file path=%v", tp)
 			}
-			_, err = io.Copy(f, c)
+			n, err := io.Copy(f, c)
+			f.Close()
+			csp.SetAttributes(attribute.Int64("bytes", n))
+			setSpanError(csp, err)
+			csp.End()
 			if err != nil {
 				return nil, errors.Wrapf(err, "failed to copy data path=%v", tp)
 			}
+			if ci.ContentType != "" {
+				err = os.WriteFile(p+contentTypeSuffix, []byte(ci.ContentType), 0644)
+				if err != nil {
+					return nil, errors.Wrapf(err, "failed to write content type path=%v", p)
+				}
+			}
 			err = os.Rename(tp, p)
 			if err != nil {
 				return nil, errors.Wrapf(err, "failed to rename file from=%v to=%v", tp, p)
 			}
-			return nil, nil
+			return res, nil
 		} else {
+			existed = true
 			t := time.Now().Local()
 			err := os.Chtimes(p, t, t)
 			if err != nil {
 				return nil, errors.Wrapf(err, "failed to change preload file modification date path=%v", p)
 			}
 			log.Infof("preload data already exists path=%v", p)
-			return nil, nil
+			return res, nil
 		}
 	})
-	return err
+	if loaded {
+		if existed {
+			return CacheStatusHit, err
+		}
+		return CacheStatusMiss, err
+	}
+	if r, ok := v.(*preloadResult); ok && r.prefetch {
+		return CacheStatusPrefetched, err
+	}
+	return CacheStatusHit, err
 }
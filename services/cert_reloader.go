@@ -0,0 +1,104 @@
+package services
+
+import (
+	"crypto/tls"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	certReloadInterval = 10 * time.Second
+)
+
+// certReloader serves TLS certificate and reloads it once files change
+type certReloader struct {
+	certPath string
+	keyPath  string
+	mux      sync.RWMutex
+	cert     *tls.Certificate
+	modTime  time.Time
+	closeCh  chan bool
+}
+
+func newCertReloader(certPath string, keyPath string) (*certReloader, error) {
+	s := &certReloader{
+		certPath: certPath,
+		keyPath:  keyPath,
+		closeCh:  make(chan bool),
+	}
+	_, err := s.reload()
+	if err != nil {
+		return nil, err
+	}
+	go s.run()
+	return s, nil
+}
+
+func (s *certReloader) lastModified() (time.Time, error) {
+	var t time.Time
+	for _, p := range []string{s.certPath, s.keyPath} {
+		fi, err := os.Stat(p)
+		if err != nil {
+			return t, errors.Wrapf(err, "failed to stat path=%v", p)
+		}
+		if fi.ModTime().After(t) {
+			t = fi.ModTime()
+		}
+	}
+	return t, nil
+}
+
+// reload loads certificate if files were modified, returns true if it was reloaded
+func (s *certReloader) reload() (bool, error) {
+	t, err := s.lastModified()
+	if err != nil {
+		return false, err
+	}
+	s.mux.RLock()
+	same := s.cert != nil && t.Equal(s.modTime)
+	s.mux.RUnlock()
+	if same {
+		return false, nil
+	}
+	cert, err := tls.LoadX509KeyPair(s.certPath, s.keyPath)
+	if err != nil {
+		return false, errors.Wrapf(err, "failed to load certificate cert=%v key=%v", s.certPath, s.keyPath)
+	}
+	s.mux.Lock()
+	s.cert = &cert
+	s.modTime = t
+	s.mux.Unlock()
+	return true, nil
+}
+
+func (s *certReloader) run() {
+	t := time.NewTicker(certReloadInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+			reloaded, err := s.reload()
+			if err != nil {
+				log.WithError(err).Warn("failed to reload certificate, keeping previous one")
+			} else if reloaded {
+				log.Infof("certificate reloaded cert=%v", s.certPath)
+			}
+		case <-s.closeCh:
+			return
+		}
+	}
+}
+
+func (s *certReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	s.mux.RLock()
+	defer s.mux.RUnlock()
+	return s.cert, nil
+}
+
+func (s *certReloader) Close() {
+	close(s.closeCh)
+}
@@ -0,0 +1,181 @@
+package services
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/andybalholm/brotli"
+)
+
+const (
+	compressMinSize     = 512
+	compressBrotliLevel = 5
+)
+
+var compressExtensions = map[string]bool{
+	".m3u8": true,
+	".mpd":  true,
+	".vtt":  true,
+	".srt":  true,
+	".ssa":  true,
+	".ass":  true,
+	".json": true,
+	".xml":  true,
+	".txt":  true,
+}
+
+var compressPaths = map[string]bool{
+	"/done": true,
+}
+
+// compressEncodings lists supported encodings in order of preference
+var compressEncodings = []string{"br", "gzip"}
+
+// negotiateEncoding picks supported encoding with highest q-value from Accept-Encoding,
+// explicitly listed encodings take precedence over *
+func negotiateEncoding(ae string) string {
+	qs := map[string]float64{}
+	for _, p := range strings.Split(ae, ",") {
+		parts := strings.Split(p, ";")
+		name := strings.ToLower(strings.TrimSpace(parts[0]))
+		if name == "" {
+			continue
+		}
+		q := 1.0
+		for _, param := range parts[1:] {
+			param = strings.TrimSpace(param)
+			if strings.HasPrefix(param, "q=") {
+				q, _ = strconv.ParseFloat(param[2:], 64)
+			}
+		}
+		qs[name] = q
+	}
+	res := ""
+	best := 0.0
+	for _, e := range compressEncodings {
+		q, ok := qs[e]
+		if !ok {
+			q = qs["*"]
+		}
+		if q > best {
+			res, best = e, q
+		}
+	}
+	return res
+}
+
+func isCompressibleType(ct string) bool {
+	ct = strings.ToLower(ct)
+	return strings.HasPrefix(ct, "text/") ||
+		strings.Contains(ct, "mpegurl") ||
+		strings.Contains(ct, "json") ||
+		strings.Contains(ct, "subrip") ||
+		strings.Contains(ct, "xml")
+}
+
+// encodedETag returns ETag of encoded representation
+func encodedETag(etag string, enc string) string {
+	if etag == "" || strings.HasSuffix(etag, "-"+enc+`"`) {
+		return etag
+	}
+	return strings.TrimSuffix(etag, `"`) + "-" + enc + `"`
+}
+
+// decodedETags strips encoding suffixes from ETags of If-None-Match
+func decodedETags(inm string) string {
+	for _, e := range compressEncodings {
+		inm = strings.ReplaceAll(inm, "-"+e+`"`, `"`)
+	}
+	return inm
+}
+
+func compress(b []byte, enc string) []byte {
+	var buf bytes.Buffer
+	var cw io.WriteCloser
+	if enc == "br" {
+		cw = brotli.NewWriterLevel(&buf, compressBrotliLevel)
+	} else {
+		cw = gzip.NewWriter(&buf)
+	}
+	cw.Write(b)
+	cw.Close()
+	return buf.Bytes()
+}
+
+// compressHandler compresses text responses such as playlists and subtitles
+func compressHandler(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !compressExtensions[strings.ToLower(filepath.Ext(r.URL.Path))] && !compressPaths[r.URL.Path] {
+			h.ServeHTTP(w, r)
+			return
+		}
+		w.Header().Add("Vary", "Accept-Encoding")
+		enc := negotiateEncoding(r.Header.Get("Accept-Encoding"))
+		if enc == "" || r.Header.Get("Range") != "" {
+			h.ServeHTTP(w, r)
+			return
+		}
+		if inm := r.Header.Get("If-None-Match"); inm != "" {
+			r.Header.Set("If-None-Match", decodedETags(inm))
+		}
+		if r.Method == http.MethodHead {
+			serveCompressedHead(w, r, h, enc)
+			return
+		}
+
+		wi := NewBufferedResponseWrtier(w)
+		h.ServeHTTP(wi, r)
+		b := wi.GetBufferedBytes()
+
+		if wi.statusCode == http.StatusNotModified {
+			w.Header().Set("ETag", encodedETag(w.Header().Get("ETag"), enc))
+			w.WriteHeader(wi.statusCode)
+			return
+		}
+		if wi.statusCode != http.StatusOK || len(b) < compressMinSize ||
+			w.Header().Get("Content-Encoding") != "" || !isCompressibleType(w.Header().Get("Content-Type")) {
+			w.WriteHeader(wi.statusCode)
+			w.Write(b)
+			return
+		}
+		cb := compress(b, enc)
+		w.Header().Set("Content-Encoding", enc)
+		w.Header().Set("Content-Length", fmt.Sprintf("%v", len(cb)))
+		if etag := w.Header().Get("ETag"); etag != "" {
+			w.Header().Set("ETag", encodedETag(etag, enc))
+		}
+		w.WriteHeader(http.StatusOK)
+		w.Write(cb)
+	})
+}
+
+// serveCompressedHead answers HEAD with headers of compressed representation,
+// its length is unknown without content, so Content-Length is omitted
+func serveCompressedHead(w http.ResponseWriter, r *http.Request, h http.Handler, enc string) {
+	wi := NewBufferedResponseWrtier(w)
+	h.ServeHTTP(wi, r)
+	switch wi.statusCode {
+	case http.StatusNotModified:
+		w.Header().Set("ETag", encodedETag(w.Header().Get("ETag"), enc))
+	case http.StatusOK:
+		if w.Header().Get("Content-Encoding") != "" || !isCompressibleType(w.Header().Get("Content-Type")) {
+			break
+		}
+		if l, err := strconv.Atoi(w.Header().Get("Content-Length")); err == nil && l < compressMinSize {
+			break
+		}
+		w.Header().Set("Content-Encoding", enc)
+		w.Header().Del("Content-Length")
+		if etag := w.Header().Get("ETag"); etag != "" {
+			w.Header().Set("ETag", encodedETag(etag, enc))
+		}
+	}
+	w.WriteHeader(wi.statusCode)
+	w.Write(wi.GetBufferedBytes())
+}
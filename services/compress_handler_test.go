@@ -0,0 +1,115 @@
+package services
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/andybalholm/brotli"
+)
+
+func TestNegotiateEncoding(t *testing.T) {
+	tests := []struct {
+		ae   string
+		want string
+	}{
+		{"", ""},
+		{"identity", ""},
+		{"gzip", "gzip"},
+		{"gzip, deflate, br", "br"},
+		{"br;q=0.5, gzip", "gzip"},
+		{"*", "br"},
+		{"*;q=1, gzip;q=0", "br"},
+		{"*;q=1, gzip;q=0, br;q=0", ""},
+		{"gzip;q=0, *", "br"},
+		{"GZIP;q=0.8", "gzip"},
+		{"*;q=0", ""},
+	}
+	for _, tt := range tests {
+		if got := negotiateEncoding(tt.ae); got != tt.want {
+			t.Errorf("negotiateEncoding(%q) = %q, want %q", tt.ae, got, tt.want)
+		}
+	}
+}
+
+func TestCompress(t *testing.T) {
+	b := bytes.Repeat([]byte("#EXTINF:4.000,\nv0-1.ts?token=abc\n"), 100)
+	tests := []struct {
+		enc    string
+		reader func(io.Reader) (io.Reader, error)
+	}{
+		{"gzip", func(r io.Reader) (io.Reader, error) { return gzip.NewReader(r) }},
+		{"br", func(r io.Reader) (io.Reader, error) { return brotli.NewReader(r), nil }},
+	}
+	for _, tt := range tests {
+		cb := compress(b, tt.enc)
+		if len(cb) >= len(b) {
+			t.Errorf("%v: compressed size %v is not less than %v", tt.enc, len(cb), len(b))
+		}
+		r, err := tt.reader(bytes.NewReader(cb))
+		if err != nil {
+			t.Fatalf("%v: %v", tt.enc, err)
+		}
+		d, err := io.ReadAll(r)
+		if err != nil {
+			t.Fatalf("%v: %v", tt.enc, err)
+		}
+		if !bytes.Equal(d, b) {
+			t.Errorf("%v: decompressed content differs", tt.enc)
+		}
+	}
+}
+
+func TestEncodedETag(t *testing.T) {
+	tests := []struct {
+		etag string
+		enc  string
+		want string
+	}{
+		{"", "gzip", ""},
+		{`"abc"`, "gzip", `"abc-gzip"`},
+		{`"abc"`, "br", `"abc-br"`},
+		{`"abc-br"`, "br", `"abc-br"`},
+	}
+	for _, tt := range tests {
+		if got := encodedETag(tt.etag, tt.enc); got != tt.want {
+			t.Errorf("encodedETag(%q, %q) = %q, want %q", tt.etag, tt.enc, got, tt.want)
+		}
+	}
+	if got := decodedETags(`"a-gzip", "b-br", "c"`); got != `"a", "b", "c"` {
+		t.Errorf("decodedETags = %q", got)
+	}
+}
+
+func TestCompressHandlerHead(t *testing.T) {
+	tests := []struct {
+		name   string
+		length string
+		want   http.Header
+	}{
+		{"compressed", "1000", http.Header{"Content-Encoding": {"gzip"}, "Etag": {`"abc-gzip"`}}},
+		{"too small", "100", http.Header{"Content-Length": {"100"}, "Etag": {`"abc"`}}},
+	}
+	for _, tt := range tests {
+		h := compressHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.Method != http.MethodHead {
+				t.Errorf("%v: method = %v, want HEAD", tt.name, r.Method)
+			}
+			w.Header().Set("Content-Type", "text/vtt")
+			w.Header().Set("Content-Length", tt.length)
+			w.Header().Set("ETag", `"abc"`)
+		}))
+		r := httptest.NewRequest(http.MethodHead, "/k/s0.vtt", nil)
+		r.Header.Set("Accept-Encoding", "gzip")
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		for _, k := range []string{"Content-Encoding", "Content-Length", "Etag"} {
+			if got, want := w.Header().Get(k), tt.want.Get(k); got != want {
+				t.Errorf("%v: %v = %q, want %q", tt.name, k, got, want)
+			}
+		}
+	}
+}
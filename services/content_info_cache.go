@@ -0,0 +1,53 @@
+package services
+
+import (
+	"context"
+	"crypto/sha1"
+	"fmt"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/webtor-io/lazymap"
+)
+
+// ContentInfoCache caches object metadata, so it can be served
+// without downloading content
+type ContentInfoCache struct {
+	lazymap.LazyMap
+	s3st *S3Storage
+	dp   *DonePool
+}
+
+func NewContentInfoCache(s3st *S3Storage, dp *DonePool) *ContentInfoCache {
+	return &ContentInfoCache{
+		s3st: s3st,
+		dp:   dp,
+		LazyMap: lazymap.New(&lazymap.Config{
+			Concurrency: 100,
+			Expire:      600 * time.Second,
+			ErrorExpire: 30 * time.Second,
+			Capacity:    1000,
+		}),
+	}
+}
+
+// Get returns object metadata or nil if object does not exist
+func (s *ContentInfoCache) Get(ctx context.Context, key string, path string) (*ContentInfo, error) {
+	_, t, err := s.dp.Done(key)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to get key")
+	}
+	if t == nil {
+		return nil, &NotFoundError{errors.Errorf("content is not done key=%v", key)}
+	}
+	kk := fmt.Sprintf("%x", sha1.Sum([]byte(key+path+t.String())))
+	v, err := s.LazyMap.Get(kk, func() (interface{}, error) {
+		ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), 60*time.Second)
+		defer cancel()
+		return s.s3st.HeadContent(ctx, key, path)
+	})
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to get content info key=%v path=%v", key, path)
+	}
+	return v.(*ContentInfo), nil
+}
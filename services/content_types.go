@@ -0,0 +1,87 @@
+package services
+
+import (
+	"path/filepath"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/urfave/cli"
+)
+
+const (
+	contentTypesFlag = "content-types"
+)
+
+var defaultContentTypes = map[string]string{
+	".m3u8": "application/vnd.apple.mpegurl",
+	".mpd":  "application/dash+xml",
+	".ts":   "video/mp2t",
+	".m4s":  "video/iso.segment",
+	".mp4":  "video/mp4",
+	".m4v":  "video/mp4",
+	".m4a":  "audio/mp4",
+	".aac":  "audio/aac",
+	".vtt":  "text/vtt; charset=utf-8",
+	".srt":  "application/x-subrip",
+	".json": "application/json",
+}
+
+// genericContentTypes are set by S3 when object was uploaded without type
+var genericContentTypes = map[string]bool{
+	"binary/octet-stream":      true,
+	"application/octet-stream": true,
+}
+
+func RegisterContentTypesFlags(c *cli.App) {
+	c.Flags = append(c.Flags, cli.StringFlag{
+		Name:   contentTypesFlag,
+		Usage:  "comma separated content type overrides, e.g. .ts=video/mp2t,.vtt=text/vtt",
+		EnvVar: "CONTENT_TYPES",
+	})
+}
+
+// ContentTypes resolves content type of served objects by extension
+type ContentTypes struct {
+	types map[string]string
+}
+
+func NewContentTypes(c *cli.Context) (*ContentTypes, error) {
+	types := map[string]string{}
+	for k, v := range defaultContentTypes {
+		types[k] = v
+	}
+	for _, p := range splitList(c.String(contentTypesFlag)) {
+		parts := strings.SplitN(p, "=", 2)
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			return nil, errors.Errorf("failed to parse content type override=%v", p)
+		}
+		ext := strings.ToLower(parts[0])
+		if !strings.HasPrefix(ext, ".") {
+			ext = "." + ext
+		}
+		types[ext] = parts[1]
+	}
+	return &ContentTypes{
+		types: types,
+	}, nil
+}
+
+// Get returns content type of path, stored type is used if it was set explicitly
+func (s *ContentTypes) Get(path string, stored string) string {
+	if stored != "" && !genericContentTypes[stored] {
+		return stored
+	}
+	return s.types[strings.ToLower(filepath.Ext(path))]
+}
+
+// contentTyper is implemented by cached content that knows its stored type
+type contentTyper interface {
+	ContentType() string
+}
+
+func contentTypeOf(v interface{}) string {
+	if ct, ok := v.(contentTyper); ok {
+		return ct.ContentType()
+	}
+	return ""
+}
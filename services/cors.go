@@ -0,0 +1,201 @@
+package services
+
+import (
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/urfave/cli"
+)
+
+const (
+	corsAllowedOriginsFlag   = "cors-allowed-origins"
+	corsAllowedMethodsFlag   = "cors-allowed-methods"
+	corsAllowedHeadersFlag   = "cors-allowed-headers"
+	corsExposedHeadersFlag   = "cors-exposed-headers"
+	corsAllowCredentialsFlag = "cors-allow-credentials"
+	corsMaxAgeFlag           = "cors-max-age"
+)
+
+func RegisterCORSFlags(c *cli.App) {
+	c.Flags = append(c.Flags, cli.StringFlag{
+		Name:   corsAllowedOriginsFlag,
+		Usage:  "comma separated allowed origins, * and *.example.com wildcards are supported",
+		Value:  "*",
+		EnvVar: "CORS_ALLOWED_ORIGINS",
+	})
+	c.Flags = append(c.Flags, cli.StringFlag{
+		Name:   corsAllowedMethodsFlag,
+		Usage:  "comma separated allowed methods",
+		Value:  "GET,HEAD,OPTIONS",
+		EnvVar: "CORS_ALLOWED_METHODS",
+	})
+	c.Flags = append(c.Flags, cli.StringFlag{
+		Name:   corsAllowedHeadersFlag,
+		Usage:  "comma separated allowed request headers",
+		Value:  "Range,If-None-Match,If-Modified-Since,X-Info-Hash,X-Origin-Path,X-Key-Prefix,X-Request-ID,traceparent",
+		EnvVar: "CORS_ALLOWED_HEADERS",
+	})
+	c.Flags = append(c.Flags, cli.StringFlag{
+		Name:   corsExposedHeadersFlag,
+		Usage:  "comma separated headers exposed to browser",
+		Value:  "X-Cache-Key,X-Request-ID,Content-Range,Content-Length,Accept-Ranges,ETag,Retry-After",
+		EnvVar: "CORS_EXPOSED_HEADERS",
+	})
+	c.Flags = append(c.Flags, cli.BoolFlag{
+		Name:   corsAllowCredentialsFlag,
+		Usage:  "allow credentials in CORS requests, requires explicit allowed origins",
+		EnvVar: "CORS_ALLOW_CREDENTIALS",
+	})
+	c.Flags = append(c.Flags, cli.IntFlag{
+		Name:   corsMaxAgeFlag,
+		Usage:  "preflight cache max age in seconds",
+		Value:  86400,
+		EnvVar: "CORS_MAX_AGE",
+	})
+}
+
+func splitList(v string) []string {
+	res := []string{}
+	for _, s := range strings.Split(v, ",") {
+		if s = strings.TrimSpace(s); s != "" {
+			res = append(res, s)
+		}
+	}
+	return res
+}
+
+// CORS applies configured cross-origin policy and answers preflight requests
+type CORS struct {
+	origins     []string
+	methods     string
+	headers     []string
+	exposed     string
+	credentials bool
+	maxAge      int
+}
+
+func NewCORS(c *cli.Context) (*CORS, error) {
+	s := &CORS{
+		origins:     splitList(c.String(corsAllowedOriginsFlag)),
+		methods:     strings.Join(splitList(c.String(corsAllowedMethodsFlag)), ", "),
+		headers:     splitList(c.String(corsAllowedHeadersFlag)),
+		exposed:     strings.Join(splitList(c.String(corsExposedHeadersFlag)), ", "),
+		credentials: c.Bool(corsAllowCredentialsFlag),
+		maxAge:      c.Int(corsMaxAgeFlag),
+	}
+	// reflecting any origin together with credentials exposes
+	// credentialed responses to every site
+	if s.credentials && s.wildcard() {
+		return nil, errors.Errorf("%v=* can not be used with %v, explicit origins are required", corsAllowedOriginsFlag, corsAllowCredentialsFlag)
+	}
+	return s, nil
+}
+
+func (s *CORS) wildcard() bool {
+	for _, o := range s.origins {
+		if o == "*" {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *CORS) allowedOrigin(origin string) bool {
+	for _, o := range s.origins {
+		if o == "*" || strings.EqualFold(o, origin) {
+			return true
+		}
+		if !strings.HasPrefix(o, "*.") {
+			continue
+		}
+		// wildcard matches any port of subdomain
+		u, err := url.Parse(origin)
+		if err != nil {
+			continue
+		}
+		if strings.HasSuffix(strings.ToLower(u.Hostname()), strings.ToLower(o[1:])) {
+			return true
+		}
+	}
+	return false
+}
+
+// allowedHeaders returns requested headers if all of them are allowed
+func (s *CORS) allowedHeaders(requested string) (string, bool) {
+	rr := splitList(requested)
+	for _, r := range rr {
+		ok := false
+		for _, h := range s.headers {
+			if h == "*" || strings.EqualFold(h, r) {
+				ok = true
+				break
+			}
+		}
+		if !ok {
+			return "", false
+		}
+	}
+	return strings.Join(rr, ", "), true
+}
+
+func (s *CORS) Handler(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		origin := r.Header.Get("Origin")
+		if origin == "" {
+			// keep responses cacheable for any origin
+			if s.wildcard() {
+				w.Header().Set("Access-Control-Allow-Origin", "*")
+				if s.exposed != "" {
+					w.Header().Set("Access-Control-Expose-Headers", s.exposed)
+				}
+			}
+			h.ServeHTTP(w, r)
+			return
+		}
+		if !s.wildcard() {
+			w.Header().Add("Vary", "Origin")
+		}
+		preflight := r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != ""
+		if !s.allowedOrigin(origin) {
+			if preflight {
+				w.WriteHeader(http.StatusForbidden)
+				return
+			}
+			h.ServeHTTP(w, r)
+			return
+		}
+		if s.wildcard() {
+			w.Header().Set("Access-Control-Allow-Origin", "*")
+		} else {
+			w.Header().Set("Access-Control-Allow-Origin", origin)
+		}
+		if s.credentials {
+			w.Header().Set("Access-Control-Allow-Credentials", "true")
+		}
+		if !preflight {
+			if s.exposed != "" {
+				w.Header().Set("Access-Control-Expose-Headers", s.exposed)
+			}
+			h.ServeHTTP(w, r)
+			return
+		}
+		w.Header().Add("Vary", "Access-Control-Request-Method")
+		w.Header().Add("Vary", "Access-Control-Request-Headers")
+		rh, ok := s.allowedHeaders(r.Header.Get("Access-Control-Request-Headers"))
+		if !ok {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		w.Header().Set("Access-Control-Allow-Methods", s.methods)
+		if rh != "" {
+			w.Header().Set("Access-Control-Allow-Headers", rh)
+		}
+		if s.maxAge > 0 {
+			w.Header().Set("Access-Control-Max-Age", strconv.Itoa(s.maxAge))
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+}
@@ -0,0 +1,29 @@
+package services
+
+import (
+	"testing"
+)
+
+func TestCORSAllowedOrigin(t *testing.T) {
+	s := &CORS{origins: []string{"https://app.test", "*.example.com"}}
+	tests := []struct {
+		origin string
+		want   bool
+	}{
+		{"https://app.test", true},
+		{"https://app.test:8080", false},
+		{"https://a.example.com", true},
+		{"https://a.example.com:8443", true},
+		{"http://a.b.Example.com:80", true},
+		{"https://example.com", false},
+		{"https://badexample.com", false},
+		{"https://example.com.evil.test", false},
+		{"https://evil.test:443/.example.com", false},
+		{"null", false},
+	}
+	for _, tt := range tests {
+		if got := s.allowedOrigin(tt.origin); got != tt.want {
+			t.Errorf("allowedOrigin(%q) = %v, want %v", tt.origin, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,57 @@
+package services
+
+import (
+	"bufio"
+	"net"
+	"net/http"
+
+	"github.com/pkg/errors"
+)
+
+type countingResponseWriter struct {
+	http.ResponseWriter
+	statusCode int
+	bytes      int64
+}
+
+func NewCountingResponseWriter(w http.ResponseWriter) *countingResponseWriter {
+	return &countingResponseWriter{
+		statusCode:     http.StatusOK,
+		ResponseWriter: w,
+	}
+}
+
+func (w *countingResponseWriter) WriteHeader(statusCode int) {
+	w.statusCode = statusCode
+	w.ResponseWriter.WriteHeader(statusCode)
+}
+
+func (w *countingResponseWriter) Write(p []byte) (int, error) {
+	n, err := w.ResponseWriter.Write(p)
+	w.bytes += int64(n)
+	return n, err
+}
+
+func (w *countingResponseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	h, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("type assertion failed http.ResponseWriter not a http.Hijacker")
+	}
+	return h.Hijack()
+}
+
+func (w *countingResponseWriter) Flush() {
+	f, ok := w.ResponseWriter.(http.Flusher)
+	if !ok {
+		return
+	}
+
+	f.Flush()
+}
+
+// Check interface implementations.
+var (
+	_ http.ResponseWriter = &countingResponseWriter{}
+	_ http.Hijacker       = &countingResponseWriter{}
+	_ http.Flusher        = &countingResponseWriter{}
+)
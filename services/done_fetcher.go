@@ -4,39 +4,91 @@ import (
 	"context"
 	"sync"
 	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	doneErrorTTL    = 10
+	doneNotFoundTTL = 10
 )
 
+// DoneFetcher caches done marker state, serving stale state
+// while it is being refreshed in background
 type DoneFetcher struct {
-	st     *S3Storage
-	mux    sync.Mutex
-	err    error
-	res    bool
-	inited bool
-	ctx    context.Context
-	key    string
-	t      *time.Time
+	st         *S3Storage
+	mux        sync.Mutex
+	err        error
+	m          *DoneMarker
+	inited     bool
+	refreshing bool
+	ctx        context.Context
+	key        string
+	fetchedAt  time.Time
+	ttl        time.Duration
+	maxStale   time.Duration
 }
 
-func NewDoneFetcher(ctx context.Context, st *S3Storage, key string) *DoneFetcher {
+func NewDoneFetcher(ctx context.Context, st *S3Storage, key string, ttl time.Duration, maxStale time.Duration) *DoneFetcher {
 	return &DoneFetcher{
-		st:  st,
-		ctx: ctx,
-		key: key,
+		st:       st,
+		ctx:      ctx,
+		key:      key,
+		ttl:      ttl,
+		maxStale: maxStale,
 	}
 }
 
 func (s *DoneFetcher) Fetch() (bool, *time.Time, error) {
+	m, err := s.FetchMarker()
+	if err != nil || m == nil {
+		return false, nil, err
+	}
+	return true, m.Time, nil
+}
+
+// FetchMarker returns done marker or nil if transcoding is not done yet
+func (s *DoneFetcher) FetchMarker() (*DoneMarker, error) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	age := time.Since(s.fetchedAt)
+	// content being transcoded gets done soon, so missing marker
+	// is rechecked as often as failed fetch
+	notFound := s.err == nil && s.m == nil
+	if !s.inited || (s.err != nil && age > time.Duration(doneErrorTTL)*time.Second) ||
+		(notFound && age > time.Duration(doneNotFoundTTL)*time.Second) || age > s.ttl+s.maxStale {
+		m, err := s.fetch()
+		s.update(m, err)
+		s.inited = true
+		return s.m, s.err
+	}
+	if age > s.ttl && s.err == nil && !s.refreshing {
+		s.refreshing = true
+		go s.refresh()
+	}
+	return s.m, s.err
+}
+
+func (s *DoneFetcher) refresh() {
+	m, err := s.fetch()
 	s.mux.Lock()
 	defer s.mux.Unlock()
-	if s.inited {
-		return s.res, s.t, s.err
+	s.refreshing = false
+	s.update(m, err)
+}
+
+// update stores fetch result, stale positive result is kept on error
+// until max-stale window is exceeded
+func (s *DoneFetcher) update(m *DoneMarker, err error) {
+	if err != nil && s.inited && s.err == nil && s.m != nil && time.Since(s.fetchedAt) <= s.ttl+s.maxStale {
+		log.WithError(err).Warnf("failed to refresh done marker, serving stale key=%v", s.key)
+		return
 	}
-	s.res, s.t, s.err = s.fetch()
-	s.inited = true
-	return s.res, s.t, s.err
+	s.m, s.err = m, err
+	s.fetchedAt = time.Now()
 }
 
-func (s *DoneFetcher) fetch() (res bool, t *time.Time, err error) {
-	res, t, err = s.st.CheckDoneMarker(s.ctx, s.key)
+func (s *DoneFetcher) fetch() (m *DoneMarker, err error) {
+	m, err = s.st.CheckDoneMarker(s.ctx, s.key)
 	return
 }
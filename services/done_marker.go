@@ -0,0 +1,72 @@
+package services
+
+import (
+	"encoding/json"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	maxDoneMarkerBodySize = 1024 * 1024
+)
+
+// DoneMarker describes finished transcode, optional fields are taken
+// from marker JSON body or object metadata
+type DoneMarker struct {
+	Time         *time.Time      `json:"time,omitempty"`
+	Renditions   json.RawMessage `json:"renditions,omitempty"`
+	Duration     float64         `json:"duration,omitempty"`
+	SegmentCount int             `json:"segment_count,omitempty"`
+	TotalSize    int64           `json:"total_size,omitempty"`
+}
+
+func metaValue(meta map[string]*string, name string) string {
+	for k, v := range meta {
+		if v != nil && strings.EqualFold(strings.ReplaceAll(k, "_", "-"), name) {
+			return *v
+		}
+	}
+	return ""
+}
+
+// applyMetadata fills empty marker fields from S3 object metadata
+func (s *DoneMarker) applyMetadata(meta map[string]*string) {
+	if v := metaValue(meta, "duration"); v != "" && s.Duration == 0 {
+		s.Duration, _ = strconv.ParseFloat(v, 64)
+	}
+	if v := metaValue(meta, "segment-count"); v != "" && s.SegmentCount == 0 {
+		s.SegmentCount, _ = strconv.Atoi(v)
+	}
+	if v := metaValue(meta, "total-size"); v != "" && s.TotalSize == 0 {
+		s.TotalSize, _ = strconv.ParseInt(v, 10, 64)
+	}
+	if v := metaValue(meta, "renditions"); v != "" && len(s.Renditions) == 0 {
+		if json.Valid([]byte(v)) {
+			s.Renditions = json.RawMessage(v)
+		} else {
+			rr := []string{}
+			for _, r := range strings.Split(v, ",") {
+				if r = strings.TrimSpace(r); r != "" {
+					rr = append(rr, r)
+				}
+			}
+			s.Renditions, _ = json.Marshal(rr)
+		}
+	}
+}
+
+// applyBody fills marker fields from JSON body, non-JSON bodies are ignored
+func (s *DoneMarker) applyBody(key string, b []byte) {
+	if len(strings.TrimSpace(string(b))) == 0 || b[0] != '{' {
+		return
+	}
+	t := s.Time
+	err := json.Unmarshal(b, s)
+	if err != nil {
+		log.WithError(err).Warnf("failed to parse done marker body key=%v", key)
+	}
+	s.Time = t
+}
@@ -1,35 +1,91 @@
 package services
 
 import (
+	"container/list"
 	"context"
 	"sync"
 	"time"
+
+	"github.com/urfave/cli"
 )
 
 const (
-	doneTTL = 600
+	doneTTLFlag          = "done-ttl"
+	doneMaxStaleFlag     = "done-max-stale"
+	donePoolCapacityFlag = "done-pool-capacity"
 )
 
+func RegisterDonePoolFlags(c *cli.App) {
+	c.Flags = append(c.Flags, cli.DurationFlag{
+		Name:   doneTTLFlag,
+		Usage:  "time after which done marker is revalidated",
+		Value:  600 * time.Second,
+		EnvVar: "DONE_TTL",
+	})
+	c.Flags = append(c.Flags, cli.DurationFlag{
+		Name:   doneMaxStaleFlag,
+		Usage:  "how long stale done marker can be served while revalidating or on backend errors",
+		Value:  3600 * time.Second,
+		EnvVar: "DONE_MAX_STALE",
+	})
+	c.Flags = append(c.Flags, cli.IntFlag{
+		Name:   donePoolCapacityFlag,
+		Usage:  "max number of tracked done markers",
+		Value:  10000,
+		EnvVar: "DONE_POOL_CAPACITY",
+	})
+}
+
+type donePoolItem struct {
+	key string
+	df  *DoneFetcher
+}
+
+// DonePool keeps done fetchers of recently requested keys,
+// least recently used ones are evicted over capacity
 type DonePool struct {
-	sm     sync.Map
-	st     *S3Storage
-	expire time.Duration
+	mux      sync.Mutex
+	lru      *list.List
+	items    map[string]*list.Element
+	st       *S3Storage
+	ttl      time.Duration
+	maxStale time.Duration
+	capacity int
 }
 
-func NewDonePool(st *S3Storage) *DonePool {
+func NewDonePool(c *cli.Context, st *S3Storage) *DonePool {
 	return &DonePool{
-		expire: time.Duration(doneTTL) * time.Second,
-		st:     st,
+		lru:      list.New(),
+		items:    map[string]*list.Element{},
+		ttl:      c.Duration(doneTTLFlag),
+		maxStale: c.Duration(doneMaxStaleFlag),
+		capacity: c.Int(donePoolCapacityFlag),
+		st:       st,
 	}
 }
 
-func (s *DonePool) Done(key string) (bool, *time.Time, error) {
-	df, loaded := s.sm.LoadOrStore(key, NewDoneFetcher(context.Background(), s.st, key))
-	if !loaded {
-		go func() {
-			<-time.After(s.expire)
-			s.sm.Delete(key)
-		}()
+func (s *DonePool) get(key string) *DoneFetcher {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	if e, ok := s.items[key]; ok {
+		s.lru.MoveToFront(e)
+		return e.Value.(*donePoolItem).df
 	}
-	return df.(*DoneFetcher).Fetch()
+	df := NewDoneFetcher(context.Background(), s.st, key, s.ttl, s.maxStale)
+	s.items[key] = s.lru.PushFront(&donePoolItem{key: key, df: df})
+	for s.capacity > 0 && s.lru.Len() > s.capacity {
+		e := s.lru.Back()
+		s.lru.Remove(e)
+		delete(s.items, e.Value.(*donePoolItem).key)
+	}
+	return df
+}
+
+func (s *DonePool) Done(key string) (bool, *time.Time, error) {
+	return s.get(key).Fetch()
+}
+
+// Marker returns done marker with its metadata or nil if transcoding is not done yet
+func (s *DonePool) Marker(key string) (*DoneMarker, error) {
+	return s.get(key).FetchMarker()
 }
@@ -3,6 +3,8 @@ package services
 import (
 	"bufio"
 	"bytes"
+	"context"
+	"crypto/sha1"
 	"fmt"
 	"net/http"
 	"regexp"
@@ -11,17 +13,59 @@ import (
 	log "github.com/sirupsen/logrus"
 )
 
-func enrichPlaylistHandler(h http.Handler) http.Handler {
+type playlistContextKey struct{}
+
+// playlistContext carries values set by inner handlers
+type playlistContext struct {
+	subtitles func() []SubtitleTrack
+	iframes   bool
+}
+
+// setPlaylistSubtitles sets provider of subtitle tracks injected into master playlist
+func setPlaylistSubtitles(r *http.Request, f func() []SubtitleTrack) {
+	if pc, ok := r.Context().Value(playlistContextKey{}).(*playlistContext); ok {
+		pc.subtitles = f
+	}
+}
+
+// setPlaylistIFrames enables injection of I-frame playlists into master playlist
+func setPlaylistIFrames(r *http.Request) {
+	if pc, ok := r.Context().Value(playlistContextKey{}).(*playlistContext); ok {
+		pc.iframes = true
+	}
+}
+
+func enrichPlaylistHandler(h http.Handler, su *SegmentURL) http.Handler {
 	re := regexp.MustCompile(`\.m3u8$`)
-	re2 := regexp.MustCompile(`[asv][0-9]+(\-[0-9]+)?(\-[0-9]+)?\.[0-9a-z]{2,4}`)
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		if !re.MatchString(r.URL.Path) {
 			h.ServeHTTP(w, r)
 			return
 		}
 
+		pf, err := newPlaylistFilter(r.URL.Query())
+		if err != nil {
+			writeAPIError(w, http.StatusBadRequest, &APIError{
+				Code:    ErrCodeInvalidRequest,
+				Message: err.Error(),
+			})
+			return
+		}
+		query := stripPlaylistFilterParams(r.URL.RawQuery)
+
 		r.Header.Del("Range")
+		// conditional requests are checked against rewritten playlist
+		inm := r.Header.Get("If-None-Match")
+		r.Header.Del("If-None-Match")
+		r.Header.Del("If-Modified-Since")
+
+		if r.Method == http.MethodHead {
+			servePlaylistHead(w, r, h, su, inm)
+			return
+		}
 
+		pc := &playlistContext{}
+		r = r.WithContext(context.WithValue(r.Context(), playlistContextKey{}, pc))
 		wi := NewBufferedResponseWrtier(w)
 
 		h.ServeHTTP(wi, r)
@@ -33,13 +77,30 @@ func enrichPlaylistHandler(h http.Handler) http.Handler {
 			return
 		}
 
-		var sb strings.Builder
+		lines := []string{}
 		scanner := bufio.NewScanner(bytes.NewReader(b))
 		for scanner.Scan() {
-			text := scanner.Text()
-			if r.URL.RawQuery != "" {
-				text = re2.ReplaceAllString(text, "$0?"+r.URL.RawQuery)
-			}
+			lines = append(lines, scanner.Text())
+		}
+		if err := scanner.Err(); err != nil {
+			log.Fatal(err)
+		}
+		if pf != nil && isMasterPlaylist(lines) {
+			lines = pf.Apply(lines)
+		}
+		if pc.subtitles != nil && isMasterPlaylist(lines) {
+			lines = injectSubtitles(lines, pc.subtitles())
+		}
+		if pc.iframes && isMasterPlaylist(lines) {
+			lines = injectIFramePlaylists(lines)
+		}
+		uri := func(name string) string {
+			return su.Make(r.URL.Path, name, query)
+		}
+
+		var sb strings.Builder
+		for _, text := range lines {
+			text = rewritePlaylistURIs(text, uri)
 			if text == "#EXT-X-MEDIA-SEQUENCE:0" {
 				sb.WriteString("#EXT-X-PLAYLIST-TYPE:EVENT")
 				sb.WriteRune('\n')
@@ -47,12 +108,101 @@ func enrichPlaylistHandler(h http.Handler) http.Handler {
 			sb.WriteString(text)
 			sb.WriteRune('\n')
 		}
+		if etag := w.Header().Get("ETag"); etag != "" {
+			etag = playlistETag(etag, r, su)
+			w.Header().Set("ETag", etag)
+			if etagMatch(inm, etag) {
+				w.Header().Del("Content-Length")
+				w.Header().Del("Content-Type")
+				w.WriteHeader(http.StatusNotModified)
+				return
+			}
+		}
 		w.Header().Set("Content-Length", fmt.Sprintf("%v", sb.Len()))
-		w.Header().Set("Content-Type", "application/vnd.apple.mpegurl")
+		if w.Header().Get("Content-Type") == "" {
+			w.Header().Set("Content-Type", "application/vnd.apple.mpegurl")
+		}
 		w.Write([]byte(sb.String()))
+	})
+}
 
-		if err := scanner.Err(); err != nil {
-			log.Fatal(err)
+// playlistETag returns ETag of playlist rewritten for request
+func playlistETag(etag string, r *http.Request, su *SegmentURL) string {
+	return fmt.Sprintf(`"%x"`, sha1.Sum([]byte(etag+r.URL.RawQuery+su.tpl)))
+}
+
+// servePlaylistHead answers HEAD from storage metadata with validators of rewritten
+// playlist, its length is unknown without content, so Content-Length is omitted
+func servePlaylistHead(w http.ResponseWriter, r *http.Request, h http.Handler, su *SegmentURL, inm string) {
+	wi := NewBufferedResponseWrtier(w)
+	h.ServeHTTP(wi, r)
+	if wi.statusCode != http.StatusOK {
+		w.WriteHeader(wi.statusCode)
+		w.Write(wi.GetBufferedBytes())
+		return
+	}
+	w.Header().Del("Content-Length")
+	w.Header().Del("Accept-Ranges")
+	if etag := w.Header().Get("ETag"); etag != "" {
+		etag = playlistETag(etag, r, su)
+		w.Header().Set("ETag", etag)
+		if etagMatch(inm, etag) {
+			w.Header().Del("Content-Type")
+			w.WriteHeader(http.StatusNotModified)
+			return
 		}
-	})
+	}
+	if w.Header().Get("Content-Type") == "" {
+		w.Header().Set("Content-Type", "application/vnd.apple.mpegurl")
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+// uriTags are playlist tags with URI attribute
+var uriTags = []string{"#EXT-X-MAP:", "#EXT-X-MEDIA:", "#EXT-X-I-FRAME-STREAM-INF:"}
+
+var uriAttributeRe = regexp.MustCompile(`([:,])URI="([^"]*)"`)
+
+// rewritePlaylistURIs rewrites relative URI line or URI attribute of known tag with uri,
+// other lines are returned as is
+func rewritePlaylistURIs(line string, uri func(name string) string) string {
+	if !strings.HasPrefix(line, "#") {
+		if isRelativeURI(line) {
+			return uri(line)
+		}
+		return line
+	}
+	for _, t := range uriTags {
+		if !strings.HasPrefix(line, t) {
+			continue
+		}
+		return uriAttributeRe.ReplaceAllStringFunc(line, func(a string) string {
+			m := uriAttributeRe.FindStringSubmatch(a)
+			if !isRelativeURI(m[2]) {
+				return a
+			}
+			return m[1] + `URI="` + uri(m[2]) + `"`
+		})
+	}
+	return line
+}
+
+// isRelativeURI reports whether playlist line is relative URI without query
+func isRelativeURI(line string) bool {
+	return line != "" && !strings.HasPrefix(line, "#") && !strings.HasPrefix(line, "/") &&
+		!strings.Contains(line, "://") && !strings.Contains(line, "?")
+}
+
+// etagMatch reports whether If-None-Match header value matches etag
+func etagMatch(inm string, etag string) bool {
+	if inm == "" {
+		return false
+	}
+	for _, t := range strings.Split(inm, ",") {
+		t = strings.TrimSpace(t)
+		if t == "*" || strings.TrimPrefix(t, "W/") == strings.TrimPrefix(etag, "W/") {
+			return true
+		}
+	}
+	return false
 }
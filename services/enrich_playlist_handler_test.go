@@ -0,0 +1,50 @@
+package services
+
+import (
+	"testing"
+)
+
+func TestRewritePlaylistURIs(t *testing.T) {
+	su := &SegmentURL{tpl: "https://cdn{shard}.example.com", shards: 2}
+	uri := func(name string) string {
+		return su.Make("/k/v0.m3u8", name, "token=a")
+	}
+	tests := []struct {
+		name string
+		in   string
+		want string
+	}{
+		{"segment", "v0-1.ts", "https://cdn1.example.com/k/v0-1.ts?token=a"},
+		{"playlist", "v1.m3u8", "v1.m3u8?token=a"},
+		{"absolute URI", "https://other.example.com/v0-1.ts", "https://other.example.com/v0-1.ts"},
+		{"URI with query", "v0-1.ts?sig=b", "v0-1.ts?sig=b"},
+		{"empty", "", ""},
+		{
+			"map",
+			`#EXT-X-MAP:URI="v0-0.mp4"`,
+			`#EXT-X-MAP:URI="https://cdn0.example.com/k/v0-0.mp4?token=a"`,
+		},
+		{
+			"map with byte range",
+			`#EXT-X-MAP:URI="v0.mp4",BYTERANGE="800@0"`,
+			`#EXT-X-MAP:URI="https://cdn0.example.com/k/v0.mp4?token=a",BYTERANGE="800@0"`,
+		},
+		{
+			"media attributes are kept",
+			`#EXT-X-MEDIA:TYPE=AUDIO,GROUP-ID="aud",NAME="a0-1.ts",URI="a0.m3u8"`,
+			`#EXT-X-MEDIA:TYPE=AUDIO,GROUP-ID="aud",NAME="a0-1.ts",URI="a0.m3u8?token=a"`,
+		},
+		{
+			"i-frame playlist",
+			`#EXT-X-I-FRAME-STREAM-INF:BANDWIDTH=90000,URI="v0-iframes.m3u8"`,
+			`#EXT-X-I-FRAME-STREAM-INF:BANDWIDTH=90000,URI="v0-iframes.m3u8?token=a"`,
+		},
+		{"segment-like title", "#EXTINF:4.000,v0-1.ts", "#EXTINF:4.000,v0-1.ts"},
+		{"unknown tag", `#EXT-X-KEY:METHOD=AES-128,URI="v0-1.key"`, `#EXT-X-KEY:METHOD=AES-128,URI="v0-1.key"`},
+	}
+	for _, tt := range tests {
+		if got := rewritePlaylistURIs(tt.in, uri); got != tt.want {
+			t.Errorf("%v: rewritePlaylistURIs(%q) = %q, want %q", tt.name, tt.in, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,130 @@
+package services
+
+import (
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/webtor-io/lazymap"
+)
+
+// ContentGenerator produces content missing in storage from other objects
+type ContentGenerator interface {
+	Supports(path string) bool
+	Get(ctx context.Context, key string, path string) (io.ReadSeekCloser, error)
+}
+
+// ErrGenerating is returned while content is being generated in background
+var ErrGenerating = errors.New("content is being generated")
+
+// GeneratedCache keeps generated content on disk, so it is produced only once
+type GeneratedCache struct {
+	lazymap.LazyMap
+	jobs lazymap.LazyMap
+	path string
+}
+
+func NewGeneratedCache(path string) *GeneratedCache {
+	return &GeneratedCache{
+		path: path,
+		LazyMap: lazymap.New(&lazymap.Config{
+			Concurrency: 10,
+			Expire:      60 * time.Second,
+			ErrorExpire: 30 * time.Second,
+			Capacity:    1000,
+		}),
+		jobs: lazymap.New(&lazymap.Config{
+			Concurrency: 100,
+			Expire:      30 * time.Second,
+			Capacity:    1000,
+		}),
+	}
+}
+
+type generateJob struct {
+	done chan struct{}
+	ok   bool
+	err  error
+}
+
+// Get returns cached content of kk or generates it with f, nil if f has nothing to generate
+func (s *GeneratedCache) Get(kk string, f func() ([]byte, bool, error)) (io.ReadSeekCloser, error) {
+	p := filepath.Join(s.path, kk)
+	v, err := s.LazyMap.Get(kk, func() (interface{}, error) {
+		if _, err := os.Stat(p); err == nil {
+			return true, nil
+		}
+		data, ok, err := f()
+		if err != nil || !ok {
+			return ok, err
+		}
+		return true, s.write(p, data)
+	})
+	if err != nil {
+		return nil, err
+	}
+	if !v.(bool) {
+		return nil, nil
+	}
+	return s.open(p)
+}
+
+// GetAsync is like Get, but generates content in background
+// and returns ErrGenerating until it is done
+func (s *GeneratedCache) GetAsync(kk string, f func() ([]byte, bool, error)) (io.ReadSeekCloser, error) {
+	p := filepath.Join(s.path, kk)
+	if _, err := os.Stat(p); err == nil {
+		return s.open(p)
+	}
+	v, _ := s.jobs.Get(kk, func() (interface{}, error) {
+		j := &generateJob{done: make(chan struct{})}
+		go func() {
+			defer close(j.done)
+			c, err := s.Get(kk, f)
+			if c != nil {
+				c.Close()
+				j.ok = true
+			}
+			j.err = err
+		}()
+		return j, nil
+	})
+	j := v.(*generateJob)
+	select {
+	case <-j.done:
+	default:
+		return nil, ErrGenerating
+	}
+	if j.err != nil || !j.ok {
+		return nil, j.err
+	}
+	return s.open(p)
+}
+
+func (s *GeneratedCache) open(p string) (io.ReadSeekCloser, error) {
+	fi, err := os.Open(p)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to open generated content path=%v", p)
+	}
+	return fi, nil
+}
+
+func (s *GeneratedCache) write(p string, data []byte) error {
+	err := os.MkdirAll(s.path, 0755)
+	if err != nil {
+		return errors.Wrapf(err, "failed to create dir path=%v", s.path)
+	}
+	tp := filepath.Join(s.path, "_"+filepath.Base(p))
+	err = os.WriteFile(tp, data, 0644)
+	if err != nil {
+		return errors.Wrapf(err, "failed to write file path=%v", tp)
+	}
+	err = os.Rename(tp, p)
+	if err != nil {
+		return errors.Wrapf(err, "failed to rename file from=%v to=%v", tp, p)
+	}
+	return nil
+}
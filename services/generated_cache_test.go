@@ -0,0 +1,71 @@
+package services
+
+import (
+	"io"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+func waitGenerated(t *testing.T, gc *GeneratedCache, kk string, f func() ([]byte, bool, error)) (io.ReadSeekCloser, error) {
+	for i := 0; i < 100; i++ {
+		c, err := gc.GetAsync(kk, f)
+		if err != ErrGenerating {
+			return c, err
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("content was not generated kk=%v", kk)
+	return nil, nil
+}
+
+func TestGeneratedCacheGetAsync(t *testing.T) {
+	tests := []struct {
+		name    string
+		data    []byte
+		ok      bool
+		err     error
+		want    string
+		wantErr bool
+	}{
+		{name: "generated", data: []byte("#EXTM3U\n"), ok: true, want: "#EXTM3U\n"},
+		{name: "nothing to generate", ok: false},
+		{name: "error", err: errors.New("failed"), wantErr: true},
+	}
+	for _, tt := range tests {
+		gc := NewGeneratedCache(t.TempDir())
+		release := make(chan bool)
+		calls := 0
+		f := func() ([]byte, bool, error) {
+			calls++
+			<-release
+			return tt.data, tt.ok, tt.err
+		}
+		if _, err := gc.GetAsync("kk", f); err != ErrGenerating {
+			t.Fatalf("%v: first GetAsync() error = %v, want ErrGenerating", tt.name, err)
+		}
+		if _, err := gc.GetAsync("kk", f); err != ErrGenerating {
+			t.Fatalf("%v: second GetAsync() error = %v, want ErrGenerating", tt.name, err)
+		}
+		close(release)
+		c, err := waitGenerated(t, gc, "kk", f)
+		if (err != nil) != tt.wantErr {
+			t.Fatalf("%v: GetAsync() error = %v, wantErr %v", tt.name, err, tt.wantErr)
+		}
+		if calls != 1 {
+			t.Errorf("%v: content generated %v times", tt.name, calls)
+		}
+		if !tt.ok {
+			if c != nil {
+				t.Errorf("%v: GetAsync() returned content", tt.name)
+			}
+			continue
+		}
+		b, _ := io.ReadAll(c)
+		c.Close()
+		if string(b) != tt.want {
+			t.Errorf("%v: content = %q, want %q", tt.name, b, tt.want)
+		}
+	}
+}
@@ -0,0 +1,408 @@
+package services
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha1"
+	"fmt"
+	"io"
+	"math"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/urfave/cli"
+)
+
+const (
+	iframePlaylistsFlag     = "iframe-playlists"
+	iframePlaylistCachePath = "cache/iframes"
+	iframePlaylistSuffix    = "-iframes.m3u8"
+	maxIFrameSegmentSize    = 64 * 1024 * 1024
+	iframeTSReadSize        = 128 * 1024
+)
+
+func RegisterIFramePlaylistFlags(c *cli.App) {
+	c.Flags = append(c.Flags, cli.BoolFlag{
+		Name:   iframePlaylistsFlag,
+		Usage:  "generate I-frame playlists from segment keyframes and add them to master playlists",
+		EnvVar: "IFRAME_PLAYLISTS",
+	})
+}
+
+// IFramePlaylist generates EXT-X-I-FRAMES-ONLY playlists in background
+// by reading keyframe starting every segment of media playlist
+type IFramePlaylist struct {
+	enabled bool
+	c       ContentCache
+	s3st    *S3Storage
+	ci      *ContentInfoCache
+	bp      *ByteRangePlaylist
+	dp      *DonePool
+	tr      *Tracer
+	files   *GeneratedCache
+}
+
+func NewIFramePlaylist(c *cli.Context, ca ContentCache, s3st *S3Storage, ci *ContentInfoCache, bp *ByteRangePlaylist, dp *DonePool, tr *Tracer) *IFramePlaylist {
+	return &IFramePlaylist{
+		enabled: c.Bool(iframePlaylistsFlag),
+		c:       ca,
+		s3st:    s3st,
+		ci:      ci,
+		bp:      bp,
+		dp:      dp,
+		tr:      tr,
+		files:   NewGeneratedCache(iframePlaylistCachePath),
+	}
+}
+
+func (s *IFramePlaylist) Enabled() bool {
+	return s.enabled
+}
+
+func (s *IFramePlaylist) Supports(p string) bool {
+	return s.enabled && strings.HasSuffix(p, iframePlaylistSuffix)
+}
+
+func (s *IFramePlaylist) makeKey(key string, p string) (string, error) {
+	_, t, err := s.dp.Done(key)
+	if err != nil {
+		return "", errors.Wrapf(err, "failed to get key")
+	}
+	if t == nil {
+		return "", &NotFoundError{errors.Errorf("content is not done key=%v", key)}
+	}
+	return fmt.Sprintf("%x", sha1.Sum([]byte(key+p+t.String()))), nil
+}
+
+// Get returns I-frame playlist of media playlist, nil if there is no media playlist
+// and ErrGenerating while playlist is being generated
+func (s *IFramePlaylist) Get(ctx context.Context, key string, p string) (io.ReadSeekCloser, error) {
+	kk, err := s.makeKey(key, p)
+	if err != nil {
+		return nil, err
+	}
+	f, err := s.files.GetAsync(kk, func() ([]byte, bool, error) {
+		ctx, sp := s.tr.Start(context.WithoutCancel(ctx), "iframe_playlist.generate")
+		defer sp.End()
+		ctx, cancel := context.WithTimeout(ctx, 5*time.Minute)
+		defer cancel()
+		res, ok, err := s.generate(ctx, key, p)
+		setSpanError(sp, err)
+		return []byte(res), ok, err
+	})
+	if err == ErrGenerating {
+		return nil, err
+	}
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to generate I-frame playlist key=%v path=%v", key, p)
+	}
+	return f, nil
+}
+
+type mediaSegment struct {
+	uri      string
+	offset   int64
+	size     int64
+	duration float64
+}
+
+type mediaPlaylist struct {
+	mapURI    string
+	mapOffset int64
+	mapSize   int64
+	segments  []*mediaSegment
+}
+
+// parseByteRange parses length[@offset] value, prev is used when offset is missing
+func parseByteRange(v string, prev int64) (int64, int64) {
+	parts := strings.SplitN(v, "@", 2)
+	size, _ := strconv.ParseInt(parts[0], 10, 64)
+	offset := prev
+	if len(parts) == 2 {
+		offset, _ = strconv.ParseInt(parts[1], 10, 64)
+	}
+	return size, offset
+}
+
+func stripQuery(uri string) string {
+	if i := strings.Index(uri, "?"); i >= 0 {
+		return uri[:i]
+	}
+	return uri
+}
+
+func parseMediaPlaylist(b []byte) *mediaPlaylist {
+	res := &mediaPlaylist{}
+	var duration float64
+	var size, offset int64 = -1, 0
+	next := map[string]int64{}
+	scanner := bufio.NewScanner(strings.NewReader(string(b)))
+	for scanner.Scan() {
+		l := strings.TrimSpace(scanner.Text())
+		switch {
+		case strings.HasPrefix(l, "#EXTINF:"):
+			v := strings.SplitN(strings.TrimPrefix(l, "#EXTINF:"), ",", 2)[0]
+			duration, _ = strconv.ParseFloat(v, 64)
+		case strings.HasPrefix(l, "#EXT-X-BYTERANGE:"):
+			size, offset = parseByteRange(strings.TrimPrefix(l, "#EXT-X-BYTERANGE:"), -1)
+		case strings.HasPrefix(l, "#EXT-X-MAP:"):
+			attrs := parseAttributes(l)
+			res.mapURI = stripQuery(attrs["URI"])
+			res.mapSize = -1
+			if br := attrs["BYTERANGE"]; br != "" {
+				res.mapSize, res.mapOffset = parseByteRange(br, 0)
+			}
+		case l != "" && !strings.HasPrefix(l, "#"):
+			uri := stripQuery(l)
+			if size >= 0 && offset < 0 {
+				offset = next[uri]
+			}
+			seg := &mediaSegment{uri: uri, offset: offset, size: size, duration: duration}
+			if size >= 0 {
+				next[uri] = offset + size
+			} else {
+				seg.offset = 0
+			}
+			res.segments = append(res.segments, seg)
+			duration, size, offset = 0, -1, 0
+		}
+	}
+	return res
+}
+
+// open returns ranged reader of segment, segment size is set if it was unknown
+func (s *IFramePlaylist) open(ctx context.Context, key string, p string, seg *mediaSegment) (*rangeReader, error) {
+	r, err := newS3RangeReader(ctx, s.s3st, s.ci, key, p)
+	if err != nil {
+		return nil, err
+	}
+	if r == nil {
+		return nil, errors.Errorf("content not found path=%v", p)
+	}
+	if seg.size < 0 || seg.offset+seg.size > r.size {
+		seg.size = r.size - seg.offset
+	}
+	return r, nil
+}
+
+func (s *IFramePlaylist) mediaPlaylist(ctx context.Context, key string, p string) ([]byte, bool, error) {
+	c, _, err := s.c.Get(ctx, key, p)
+	if err != nil {
+		return nil, false, err
+	}
+	if c == nil {
+		if c, err = s.bp.Get(ctx, key, p); err != nil || c == nil {
+			return nil, false, err
+		}
+	}
+	defer c.Close()
+	b, err := io.ReadAll(c)
+	if err != nil {
+		return nil, false, errors.Wrapf(err, "failed to read media playlist path=%v", p)
+	}
+	return b, true, nil
+}
+
+type iframe struct {
+	uri    string
+	offset int64
+	size   int64
+	time   float64
+}
+
+func (s *IFramePlaylist) generate(ctx context.Context, key string, p string) (string, bool, error) {
+	mp := strings.TrimSuffix(p, iframePlaylistSuffix) + ".m3u8"
+	b, ok, err := s.mediaPlaylist(ctx, key, mp)
+	if err != nil || !ok {
+		return "", false, err
+	}
+	pl := parseMediaPlaylist(b)
+	dir := path.Dir(mp)
+	var track *mp4Track
+	if pl.mapURI != "" {
+		init := &mediaSegment{uri: pl.mapURI, offset: pl.mapOffset, size: pl.mapSize}
+		r, err := s.open(ctx, key, path.Join(dir, init.uri), init)
+		if err != nil {
+			return "", false, err
+		}
+		_, moov, err := findMP4Box(r, init.offset, init.offset+init.size, "moov")
+		if err != nil {
+			return "", false, errors.Wrapf(err, "failed to read init segment path=%v", pl.mapURI)
+		}
+		if moov != nil {
+			track = mainTrack(parseMP4Moov(moov))
+		}
+		if track == nil || track.timescale == 0 {
+			return "", false, errors.Errorf("failed to find track in init segment path=%v", pl.mapURI)
+		}
+	}
+	frames := []*iframe{}
+	tsMap := ""
+	var start float64
+	for i, seg := range pl.segments {
+		r, err := s.open(ctx, key, path.Join(dir, seg.uri), seg)
+		if err != nil {
+			return "", false, err
+		}
+		var f *iframe
+		if track != nil {
+			f, err = mp4IFrame(r, track, seg)
+		} else {
+			var tables bool
+			f, tables, err = tsIFrame(r, seg)
+			if i == 0 && tables {
+				tsMap = fmt.Sprintf("#EXT-X-MAP:URI=\"%v\",BYTERANGE=\"%v@%v\"", seg.uri, 2*tsPacketSize, seg.offset)
+			}
+		}
+		if err != nil {
+			return "", false, errors.Wrapf(err, "failed to read segment path=%v", seg.uri)
+		}
+		if f != nil {
+			f.time = start
+			frames = append(frames, f)
+		}
+		start += seg.duration
+	}
+	if len(frames) == 0 {
+		return "", false, errors.Errorf("no keyframes found path=%v", mp)
+	}
+	var sb strings.Builder
+	durations := make([]float64, len(frames))
+	td := 0.0
+	for i, f := range frames {
+		end := start
+		if i+1 < len(frames) {
+			end = frames[i+1].time
+		}
+		durations[i] = math.Max(end-f.time, 0.001)
+		td = math.Max(td, durations[i])
+	}
+	sb.WriteString("#EXTM3U\n")
+	if pl.mapURI != "" {
+		sb.WriteString("#EXT-X-VERSION:7\n")
+	} else {
+		sb.WriteString("#EXT-X-VERSION:5\n")
+	}
+	sb.WriteString(fmt.Sprintf("#EXT-X-TARGETDURATION:%v\n", int(math.Ceil(td))))
+	sb.WriteString("#EXT-X-PLAYLIST-TYPE:VOD\n")
+	sb.WriteString("#EXT-X-I-FRAMES-ONLY\n")
+	if pl.mapURI != "" {
+		m := fmt.Sprintf("#EXT-X-MAP:URI=\"%v\"", pl.mapURI)
+		if pl.mapSize >= 0 {
+			m += fmt.Sprintf(",BYTERANGE=\"%v@%v\"", pl.mapSize, pl.mapOffset)
+		}
+		sb.WriteString(m + "\n")
+	} else if tsMap != "" {
+		sb.WriteString(tsMap + "\n")
+	}
+	for i, f := range frames {
+		sb.WriteString(fmt.Sprintf("#EXTINF:%.3f,\n", durations[i]))
+		sb.WriteString(fmt.Sprintf("#EXT-X-BYTERANGE:%v@%v\n", f.size, f.offset))
+		sb.WriteString(f.uri + "\n")
+	}
+	sb.WriteString("#EXT-X-ENDLIST\n")
+	return sb.String(), true, nil
+}
+
+// mp4IFrame returns sync sample starting the first movie fragment of fMP4 segment,
+// nil if the fragment does not start with sync sample
+func mp4IFrame(r io.ReadSeeker, track *mp4Track, seg *mediaSegment) (*iframe, error) {
+	b, moof, err := findMP4Box(r, seg.offset, seg.offset+seg.size, "moof")
+	if err != nil || b == nil {
+		return nil, err
+	}
+	if n, sync, ok := parseMoofKeyframe(moof, track); ok && sync {
+		return &iframe{uri: seg.uri, offset: b.offset, size: n}, nil
+	}
+	return nil, nil
+}
+
+// tsIFrame returns the first keyframe of MPEG-TS segment and whether segment starts with PAT and PMT.
+// Segment is read in growing chunks until the keyframe is followed by another video PES.
+func tsIFrame(r io.ReadSeeker, seg *mediaSegment) (*iframe, bool, error) {
+	if _, err := r.Seek(seg.offset, io.SeekStart); err != nil {
+		return nil, false, errors.Wrap(err, "failed to seek")
+	}
+	size := seg.size
+	if size > maxIFrameSegmentSize {
+		size = maxIFrameSegmentSize
+	}
+	var data []byte
+	for n := int64(iframeTSReadSize); ; n *= 2 {
+		if n > size {
+			n = size
+		}
+		buf := make([]byte, n-int64(len(data)))
+		if _, err := io.ReadFull(r, buf); err != nil {
+			return nil, false, errors.Wrap(err, "failed to read segment")
+		}
+		data = append(data, buf...)
+		kf, tables := scanTSKeyframes(data)
+		complete := len(kf) > 0 && kf[0].offset+kf[0].size < int64(len(data)/tsPacketSize*tsPacketSize)
+		if complete || n == size {
+			if len(kf) == 0 {
+				return nil, tables, nil
+			}
+			return &iframe{uri: seg.uri, offset: seg.offset + kf[0].offset, size: kf[0].size}, tables, nil
+		}
+	}
+}
+
+var videoCodecPrefixes = []string{"avc1", "avc3", "hvc1", "hev1", "mp4v", "av01", "vp09", "dvh1", "dvhe"}
+
+// injectIFramePlaylists adds EXT-X-I-FRAME-STREAM-INF for video variants
+// of master playlist without I-frame playlists
+func injectIFramePlaylists(lines []string) []string {
+	for _, l := range lines {
+		if strings.HasPrefix(l, "#EXT-X-I-FRAME-STREAM-INF") {
+			return lines
+		}
+	}
+	res := make([]string, 0, len(lines))
+	frames := []string{}
+	seen := map[string]bool{}
+	var attrs map[string]string
+	for _, l := range lines {
+		res = append(res, l)
+		if strings.HasPrefix(l, "#EXT-X-STREAM-INF") {
+			attrs = parseAttributes(l)
+			continue
+		}
+		if attrs == nil || l == "" || strings.HasPrefix(l, "#") {
+			continue
+		}
+		a := attrs
+		attrs = nil
+		name := stripQuery(l)
+		if strings.Contains(name, "://") || !strings.HasSuffix(name, ".m3u8") || seen[name] {
+			continue
+		}
+		codecs := []string{}
+		for _, c := range splitList(a["CODECS"]) {
+			for _, p := range videoCodecPrefixes {
+				if strings.HasPrefix(c, p) {
+					codecs = append(codecs, c)
+				}
+			}
+		}
+		if a["BANDWIDTH"] == "" || (a["RESOLUTION"] == "" && len(codecs) == 0) {
+			continue
+		}
+		seen[name] = true
+		// I-frame bandwidth is known only once playlist is generated,
+		// variant bandwidth is used to keep master playlist stable
+		f := fmt.Sprintf("#EXT-X-I-FRAME-STREAM-INF:BANDWIDTH=%v", a["BANDWIDTH"])
+		if a["RESOLUTION"] != "" {
+			f += ",RESOLUTION=" + a["RESOLUTION"]
+		}
+		if len(codecs) > 0 {
+			f += fmt.Sprintf(`,CODECS="%v"`, strings.Join(codecs, ","))
+		}
+		f += fmt.Sprintf(`,URI="%v"`, strings.TrimSuffix(name, ".m3u8")+iframePlaylistSuffix)
+		frames = append(frames, f)
+	}
+	return append(res, frames...)
+}
@@ -0,0 +1,138 @@
+package services
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"reflect"
+	"testing"
+)
+
+func TestParseMediaPlaylist(t *testing.T) {
+	tests := []struct {
+		name string
+		in   string
+		want *mediaPlaylist
+	}{
+		{
+			name: "segments",
+			in:   "#EXTM3U\n#EXTINF:4.000,\nv0-0.ts?token=a\n#EXTINF:2.5,\nv0-1.ts\n#EXT-X-ENDLIST\n",
+			want: &mediaPlaylist{segments: []*mediaSegment{
+				{uri: "v0-0.ts", offset: 0, size: -1, duration: 4},
+				{uri: "v0-1.ts", offset: 0, size: -1, duration: 2.5},
+			}},
+		},
+		{
+			name: "byte ranges",
+			in: "#EXTM3U\n#EXT-X-MAP:URI=\"v0.mp4\",BYTERANGE=\"800@0\"\n" +
+				"#EXTINF:2.000,\n#EXT-X-BYTERANGE:1000@800\nv0.mp4\n" +
+				"#EXTINF:2.000,\n#EXT-X-BYTERANGE:500\nv0.mp4\n",
+			want: &mediaPlaylist{mapURI: "v0.mp4", mapOffset: 0, mapSize: 800, segments: []*mediaSegment{
+				{uri: "v0.mp4", offset: 800, size: 1000, duration: 2},
+				{uri: "v0.mp4", offset: 1800, size: 500, duration: 2},
+			}},
+		},
+		{
+			name: "map without byte range",
+			in:   "#EXTM3U\n#EXT-X-MAP:URI=\"init.mp4\"\n#EXTINF:2,\nv0-0.m4s\n",
+			want: &mediaPlaylist{mapURI: "init.mp4", mapSize: -1, segments: []*mediaSegment{
+				{uri: "v0-0.m4s", offset: 0, size: -1, duration: 2},
+			}},
+		},
+	}
+	for _, tt := range tests {
+		if got := parseMediaPlaylist([]byte(tt.in)); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%v: parseMediaPlaylist() = %+v, want %+v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestTSIFrame(t *testing.T) {
+	ts := testTS()
+	tests := []struct {
+		name   string
+		data   []byte
+		seg    *mediaSegment
+		want   *iframe
+		tables bool
+	}{
+		{
+			name:   "segment file",
+			data:   ts,
+			seg:    &mediaSegment{uri: "v0-0.ts", size: int64(len(ts))},
+			want:   &iframe{uri: "v0-0.ts", offset: 2 * tsPacketSize, size: 3 * tsPacketSize},
+			tables: true,
+		},
+		{
+			name:   "byte range",
+			data:   append(append(bytes.Repeat([]byte{0}, 1000), ts...), bytes.Repeat([]byte{0}, 1000)...),
+			seg:    &mediaSegment{uri: "v0.ts", offset: 1000, size: int64(len(ts))},
+			want:   &iframe{uri: "v0.ts", offset: 1000 + 2*tsPacketSize, size: 3 * tsPacketSize},
+			tables: true,
+		},
+		{
+			name:   "no keyframes",
+			data:   ts[:2*tsPacketSize],
+			seg:    &mediaSegment{uri: "v0-0.ts", size: 2 * tsPacketSize},
+			tables: true,
+		},
+	}
+	for _, tt := range tests {
+		f, tables, err := tsIFrame(bytes.NewReader(tt.data), tt.seg)
+		if err != nil {
+			t.Fatalf("%v: %v", tt.name, err)
+		}
+		if !reflect.DeepEqual(f, tt.want) || tables != tt.tables {
+			t.Errorf("%v: tsIFrame() = %+v, %v, want %+v, %v", tt.name, f, tables, tt.want, tt.tables)
+		}
+	}
+}
+
+func TestMP4IFrame(t *testing.T) {
+	file, initSize, sizes := testFragmentedMP4(2, false)
+	track := &mp4Track{id: 1, timescale: 90000}
+	styp := testBox("styp", []byte("msdh"))
+	segment := append(styp, file[initSize:initSize+sizes[0]]...)
+	nonSync := append(testMoof(1, 0x01010000), testBox("mdat", make([]byte, 100))...)
+	tests := []struct {
+		name string
+		data []byte
+		seg  *mediaSegment
+		want *iframe
+	}{
+		{
+			name: "byte range",
+			data: file,
+			seg:  &mediaSegment{uri: "v0.mp4", offset: initSize + sizes[0], size: sizes[1]},
+			want: &iframe{uri: "v0.mp4", offset: initSize + sizes[0], size: 68},
+		},
+		{
+			name: "segment with styp",
+			data: segment,
+			seg:  &mediaSegment{uri: "v0-0.m4s", size: int64(len(segment))},
+			want: &iframe{uri: "v0-0.m4s", offset: int64(len(styp)), size: 68},
+		},
+		{
+			name: "non-sync first sample",
+			data: nonSync,
+			seg:  &mediaSegment{uri: "v0-1.m4s", size: int64(len(nonSync))},
+		},
+	}
+	for _, tt := range tests {
+		requests := 0
+		r := newRangeReader(context.Background(), int64(len(tt.data)), 64, func(ctx context.Context, start int64, end int64) (io.ReadCloser, error) {
+			requests++
+			return io.NopCloser(bytes.NewReader(tt.data[start : end+1])), nil
+		})
+		f, err := mp4IFrame(r, track, tt.seg)
+		if err != nil {
+			t.Fatalf("%v: %v", tt.name, err)
+		}
+		if !reflect.DeepEqual(f, tt.want) {
+			t.Errorf("%v: mp4IFrame() = %+v, want %+v", tt.name, f, tt.want)
+		}
+		if requests > 3 {
+			t.Errorf("%v: made %v range requests, want at most 3", tt.name, requests)
+		}
+	}
+}
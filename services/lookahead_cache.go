@@ -1,18 +1,31 @@
 package services
 
 import (
+	"context"
 	"io"
 	"strconv"
 	"strings"
 	"time"
 
+	"github.com/urfave/cli"
 	"github.com/webtor-io/lazymap"
 )
 
 const (
-	lookaheadNum int = 10
+	lookaheadNum               int = 10
+	lookaheadMinRequestsFlag       = "lookahead-min-requests"
+	lookaheadMinRequestsWindow     = 5 * time.Minute
 )
 
+func RegisterLookaheadCacheFlags(c *cli.App) {
+	c.Flags = append(c.Flags, cli.IntFlag{
+		Name:   lookaheadMinRequestsFlag,
+		Usage:  "min requests of the key in last 5 minutes to start lookahead",
+		Value:  0,
+		EnvVar: "LOOKAHEAD_MIN_REQUESTS",
+	})
+}
+
 type Fragment struct {
 	num    int
 	prefix string
@@ -57,14 +70,18 @@ func (s *Fragment) String() string {
 
 type LookaheadCache struct {
 	lazymap.LazyMap
-	c *Cache
-	n int
+	c   *Cache
+	st  *Stats
+	n   int
+	min int64
 }
 
-func NewLookaheadCache(c *Cache) *LookaheadCache {
+func NewLookaheadCache(c *cli.Context, ca *Cache, st *Stats) *LookaheadCache {
 	return &LookaheadCache{
-		c: c,
-		n: lookaheadNum,
+		c:   ca,
+		st:  st,
+		n:   lookaheadNum,
+		min: int64(c.Int(lookaheadMinRequestsFlag)),
 		LazyMap: lazymap.New(&lazymap.Config{
 			Concurrency: 100,
 			Expire:      60 * time.Second,
@@ -74,9 +91,9 @@ func NewLookaheadCache(c *Cache) *LookaheadCache {
 	}
 }
 
-func (s *LookaheadCache) Get(key string, path string) (io.ReadSeekCloser, error) {
+func (s *LookaheadCache) Get(ctx context.Context, key string, path string) (io.ReadSeekCloser, CacheStatus, error) {
 	go s.Preload(key, path)
-	return s.c.Get(key, path)
+	return s.c.Get(ctx, key, path)
 }
 
 func (s *LookaheadCache) Preload(key string, path string) {
@@ -84,6 +101,9 @@ func (s *LookaheadCache) Preload(key string, path string) {
 	if f == nil {
 		return
 	}
+	if s.min > 0 && s.st.Requests(key, lookaheadMinRequestsWindow) < s.min {
+		return
+	}
 	kk := key + f.prefix + f.suffix
 	v, _ := s.LazyMap.Get(kk, func() (interface{}, error) {
 		q := NewQueue(3)
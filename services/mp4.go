@@ -0,0 +1,440 @@
+package services
+
+import (
+	"encoding/binary"
+	"io"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	maxMP4HeaderBoxSize = 64 * 1024 * 1024
+	maxMP4FragmentBoxes = 100000
+)
+
+type mp4Box struct {
+	typ    string
+	offset int64
+	size   int64
+	header int64
+}
+
+func (s *mp4Box) end() int64 {
+	return s.offset + s.size
+}
+
+// readMP4Box reads box header at current position of r
+func readMP4Box(r io.ReadSeeker, offset int64, fileSize int64) (*mp4Box, error) {
+	var h [16]byte
+	if _, err := io.ReadFull(r, h[:8]); err != nil {
+		return nil, err
+	}
+	b := &mp4Box{
+		typ:    string(h[4:8]),
+		offset: offset,
+		size:   int64(binary.BigEndian.Uint32(h[:4])),
+		header: 8,
+	}
+	switch b.size {
+	case 0:
+		b.size = fileSize - offset
+	case 1:
+		if _, err := io.ReadFull(r, h[8:16]); err != nil {
+			return nil, err
+		}
+		b.size = int64(binary.BigEndian.Uint64(h[8:16]))
+		b.header = 16
+	}
+	if b.size < b.header || offset+b.size > fileSize {
+		return nil, errors.Errorf("invalid box size type=%v offset=%v size=%v", b.typ, offset, b.size)
+	}
+	return b, nil
+}
+
+// findMP4Box walks boxes between offset and end and returns payload of the first box of type typ,
+// nil if there is none
+func findMP4Box(r io.ReadSeeker, offset int64, end int64, typ string) (*mp4Box, []byte, error) {
+	for i := 0; offset < end && i < maxMP4FragmentBoxes; i++ {
+		if _, err := r.Seek(offset, io.SeekStart); err != nil {
+			return nil, nil, errors.Wrap(err, "failed to seek")
+		}
+		b, err := readMP4Box(r, offset, end)
+		if err != nil {
+			return nil, nil, errors.Wrapf(err, "failed to read box offset=%v", offset)
+		}
+		if b.typ == typ {
+			if b.size > maxMP4HeaderBoxSize {
+				return nil, nil, errors.Errorf("box is too large type=%v size=%v", b.typ, b.size)
+			}
+			p := make([]byte, b.size-b.header)
+			if _, err := io.ReadFull(r, p); err != nil {
+				return nil, nil, errors.Wrapf(err, "failed to read box type=%v", b.typ)
+			}
+			return b, p, nil
+		}
+		offset = b.end()
+	}
+	return nil, nil, nil
+}
+
+// mp4Children iterates over child boxes of box payload
+func mp4Children(data []byte, f func(typ string, payload []byte) bool) {
+	for len(data) >= 8 {
+		size := int(binary.BigEndian.Uint32(data[:4]))
+		typ := string(data[4:8])
+		header := 8
+		if size == 1 && len(data) >= 16 {
+			size = int(binary.BigEndian.Uint64(data[8:16]))
+			header = 16
+		} else if size == 0 {
+			size = len(data)
+		}
+		if size < header || size > len(data) {
+			return
+		}
+		if !f(typ, data[header:size]) {
+			return
+		}
+		data = data[size:]
+	}
+}
+
+func mp4Child(data []byte, typ string) []byte {
+	var res []byte
+	mp4Children(data, func(t string, p []byte) bool {
+		if t == typ {
+			res = p
+			return false
+		}
+		return true
+	})
+	return res
+}
+
+type mp4Track struct {
+	id              uint32
+	timescale       uint32
+	handler         string
+	defaultDuration uint32
+}
+
+// parseMP4Moov returns tracks of movie box payload
+func parseMP4Moov(moov []byte) []*mp4Track {
+	tracks := []*mp4Track{}
+	mp4Children(moov, func(typ string, p []byte) bool {
+		if typ != "trak" {
+			return true
+		}
+		t := &mp4Track{}
+		if tkhd := mp4Child(p, "tkhd"); len(tkhd) >= 24 && tkhd[0] == 1 {
+			t.id = binary.BigEndian.Uint32(tkhd[20:24])
+		} else if len(tkhd) >= 16 {
+			t.id = binary.BigEndian.Uint32(tkhd[12:16])
+		}
+		if mdia := mp4Child(p, "mdia"); mdia != nil {
+			if mdhd := mp4Child(mdia, "mdhd"); len(mdhd) >= 24 && mdhd[0] == 1 {
+				t.timescale = binary.BigEndian.Uint32(mdhd[20:24])
+			} else if len(mdhd) >= 16 {
+				t.timescale = binary.BigEndian.Uint32(mdhd[12:16])
+			}
+			if hdlr := mp4Child(mdia, "hdlr"); len(hdlr) >= 12 {
+				t.handler = string(hdlr[8:12])
+			}
+		}
+		tracks = append(tracks, t)
+		return true
+	})
+	if mvex := mp4Child(moov, "mvex"); mvex != nil {
+		mp4Children(mvex, func(typ string, p []byte) bool {
+			if typ != "trex" || len(p) < 16 {
+				return true
+			}
+			id := binary.BigEndian.Uint32(p[4:8])
+			for _, t := range tracks {
+				if t.id == id {
+					t.defaultDuration = binary.BigEndian.Uint32(p[12:16])
+				}
+			}
+			return true
+		})
+	}
+	return tracks
+}
+
+// mainTrack prefers video track
+func mainTrack(tracks []*mp4Track) *mp4Track {
+	for _, t := range tracks {
+		if t.handler == "vide" {
+			return t
+		}
+	}
+	if len(tracks) > 0 {
+		return tracks[0]
+	}
+	return nil
+}
+
+type mp4Fragment struct {
+	offset   int64
+	size     int64
+	duration float64
+}
+
+// mp4Index describes fragments of fragmented MP4 file
+type mp4Index struct {
+	initSize  int64
+	fragments []*mp4Fragment
+}
+
+// parseSidx returns fragments referenced by segment index box that ends at end
+func parseSidx(p []byte, end int64) ([]*mp4Fragment, uint32, error) {
+	if len(p) < 12 {
+		return nil, 0, errors.New("sidx box is too short")
+	}
+	v := p[0]
+	id := binary.BigEndian.Uint32(p[4:8])
+	timescale := binary.BigEndian.Uint32(p[8:12])
+	if timescale == 0 {
+		return nil, 0, errors.New("sidx timescale is zero")
+	}
+	var firstOffset int64
+	pos := 12
+	if v == 0 {
+		if len(p) < pos+8 {
+			return nil, 0, errors.New("sidx box is too short")
+		}
+		firstOffset = int64(binary.BigEndian.Uint32(p[pos+4 : pos+8]))
+		pos += 8
+	} else {
+		if len(p) < pos+16 {
+			return nil, 0, errors.New("sidx box is too short")
+		}
+		firstOffset = int64(binary.BigEndian.Uint64(p[pos+8 : pos+16]))
+		pos += 16
+	}
+	if len(p) < pos+4 {
+		return nil, 0, errors.New("sidx box is too short")
+	}
+	count := int(binary.BigEndian.Uint16(p[pos+2 : pos+4]))
+	pos += 4
+	if len(p) < pos+count*12 {
+		return nil, 0, errors.New("sidx references are truncated")
+	}
+	offset := end + firstOffset
+	res := make([]*mp4Fragment, 0, count)
+	for i := 0; i < count; i++ {
+		ref := binary.BigEndian.Uint32(p[pos : pos+4])
+		if ref>>31 == 1 {
+			return nil, 0, errors.New("hierarchical sidx is not supported")
+		}
+		size := int64(ref & 0x7fffffff)
+		dur := binary.BigEndian.Uint32(p[pos+4 : pos+8])
+		res = append(res, &mp4Fragment{
+			offset:   offset,
+			size:     size,
+			duration: float64(dur) / float64(timescale),
+		})
+		offset += size
+		pos += 12
+	}
+	return res, id, nil
+}
+
+// parseMoofDuration returns duration of track samples in movie fragment in track timescale units
+func parseMoofDuration(moof []byte, t *mp4Track) (uint64, bool) {
+	var total uint64
+	found := false
+	mp4Children(moof, func(typ string, traf []byte) bool {
+		if typ != "traf" {
+			return true
+		}
+		tfhd := mp4Child(traf, "tfhd")
+		if len(tfhd) < 8 || binary.BigEndian.Uint32(tfhd[4:8]) != t.id {
+			return true
+		}
+		found = true
+		flags := binary.BigEndian.Uint32(tfhd[0:4]) & 0xffffff
+		def := t.defaultDuration
+		pos := 8
+		if flags&0x01 != 0 {
+			pos += 8
+		}
+		if flags&0x02 != 0 {
+			pos += 4
+		}
+		if flags&0x08 != 0 && len(tfhd) >= pos+4 {
+			def = binary.BigEndian.Uint32(tfhd[pos : pos+4])
+		}
+		mp4Children(traf, func(typ string, trun []byte) bool {
+			if typ != "trun" || len(trun) < 8 {
+				return true
+			}
+			flags := binary.BigEndian.Uint32(trun[0:4]) & 0xffffff
+			count := int(binary.BigEndian.Uint32(trun[4:8]))
+			if flags&0x100 == 0 {
+				total += uint64(count) * uint64(def)
+				return true
+			}
+			pos := 8
+			if flags&0x01 != 0 {
+				pos += 4
+			}
+			if flags&0x04 != 0 {
+				pos += 4
+			}
+			stride := 0
+			for _, f := range []uint32{0x100, 0x200, 0x400, 0x800} {
+				if flags&f != 0 {
+					stride += 4
+				}
+			}
+			for i := 0; i < count && pos+4 <= len(trun); i++ {
+				total += uint64(binary.BigEndian.Uint32(trun[pos : pos+4]))
+				pos += stride
+			}
+			return true
+		})
+		return true
+	})
+	return total, found
+}
+
+// parseMP4Index walks top-level boxes of fragmented MP4 and indexes its fragments
+// using sidx if present, otherwise moof boxes
+func parseMP4Index(r io.ReadSeeker) (*mp4Index, error) {
+	fileSize, err := r.Seek(0, io.SeekEnd)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to get file size")
+	}
+	var tracks []*mp4Track
+	var track *mp4Track
+	idx := &mp4Index{}
+	var moof *mp4Box
+	var moofDuration uint64
+	var offset int64
+	for i := 0; offset < fileSize && i < maxMP4FragmentBoxes; i++ {
+		if _, err := r.Seek(offset, io.SeekStart); err != nil {
+			return nil, errors.Wrap(err, "failed to seek")
+		}
+		b, err := readMP4Box(r, offset, fileSize)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to read box offset=%v", offset)
+		}
+		switch b.typ {
+		case "moov", "sidx", "moof":
+			if b.size > maxMP4HeaderBoxSize {
+				return nil, errors.Errorf("box is too large type=%v size=%v", b.typ, b.size)
+			}
+			p := make([]byte, b.size-b.header)
+			if _, err := io.ReadFull(r, p); err != nil {
+				return nil, errors.Wrapf(err, "failed to read box type=%v", b.typ)
+			}
+			switch b.typ {
+			case "moov":
+				tracks = parseMP4Moov(p)
+				track = mainTrack(tracks)
+				idx.initSize = b.end()
+			case "sidx":
+				ff, id, err := parseSidx(p, b.end())
+				if err != nil {
+					return nil, err
+				}
+				if track == nil || id == track.id {
+					idx.fragments = ff
+					return idx, nil
+				}
+			case "moof":
+				if track == nil || track.timescale == 0 {
+					return nil, errors.New("moof found before moov")
+				}
+				moof = b
+				moofDuration, _ = parseMoofDuration(p, track)
+			}
+		case "mdat":
+			if moof != nil {
+				idx.fragments = append(idx.fragments, &mp4Fragment{
+					offset:   moof.offset,
+					size:     b.end() - moof.offset,
+					duration: float64(moofDuration) / float64(track.timescale),
+				})
+				moof = nil
+			}
+		}
+		offset = b.end()
+	}
+	if idx.initSize == 0 || len(idx.fragments) == 0 {
+		return nil, errors.New("not a fragmented MP4")
+	}
+	return idx, nil
+}
+
+// parseMoofKeyframe returns size of byte range from moof start to the end of
+// the first sample of track and whether the sample is a sync sample
+func parseMoofKeyframe(moof []byte, t *mp4Track) (int64, bool, bool) {
+	var size int64
+	sync, found := false, false
+	mp4Children(moof, func(typ string, traf []byte) bool {
+		if typ != "traf" {
+			return true
+		}
+		tfhd := mp4Child(traf, "tfhd")
+		if len(tfhd) < 8 || binary.BigEndian.Uint32(tfhd[4:8]) != t.id {
+			return true
+		}
+		flags := binary.BigEndian.Uint32(tfhd[0:4]) & 0xffffff
+		if flags&0x01 != 0 {
+			// explicit base data offset is not relative to moof
+			return false
+		}
+		var defSize, defFlags uint32
+		pos := 8
+		if flags&0x02 != 0 {
+			pos += 4
+		}
+		if flags&0x08 != 0 {
+			pos += 4
+		}
+		if flags&0x10 != 0 && len(tfhd) >= pos+4 {
+			defSize = binary.BigEndian.Uint32(tfhd[pos : pos+4])
+			pos += 4
+		}
+		if flags&0x20 != 0 && len(tfhd) >= pos+4 {
+			defFlags = binary.BigEndian.Uint32(tfhd[pos : pos+4])
+		}
+		trun := mp4Child(traf, "trun")
+		if len(trun) < 8 || binary.BigEndian.Uint32(trun[4:8]) == 0 {
+			return false
+		}
+		tflags := binary.BigEndian.Uint32(trun[0:4]) & 0xffffff
+		if tflags&0x01 == 0 || len(trun) < 12 {
+			return false
+		}
+		dataOffset := int64(int32(binary.BigEndian.Uint32(trun[8:12])))
+		pos = 12
+		sampleFlags := defFlags
+		if tflags&0x04 != 0 && len(trun) >= pos+4 {
+			sampleFlags = binary.BigEndian.Uint32(trun[pos : pos+4])
+			pos += 4
+		}
+		sampleSize := defSize
+		if tflags&0x100 != 0 {
+			pos += 4
+		}
+		if tflags&0x200 != 0 && len(trun) >= pos+4 {
+			sampleSize = binary.BigEndian.Uint32(trun[pos : pos+4])
+			pos += 4
+		}
+		if tflags&0x400 != 0 && tflags&0x04 == 0 && len(trun) >= pos+4 {
+			sampleFlags = binary.BigEndian.Uint32(trun[pos : pos+4])
+		}
+		if sampleSize == 0 {
+			return false
+		}
+		found = true
+		// sample_is_non_sync_sample
+		sync = sampleFlags&0x00010000 == 0
+		size = dataOffset + int64(sampleSize)
+		return false
+	})
+	return size, sync, found
+}
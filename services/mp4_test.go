@@ -0,0 +1,251 @@
+package services
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"io"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func testBox(typ string, payload ...[]byte) []byte {
+	b := bytes.Join(payload, nil)
+	h := make([]byte, 8)
+	binary.BigEndian.PutUint32(h, uint32(len(b)+8))
+	copy(h[4:], typ)
+	return append(h, b...)
+}
+
+func testU32(v ...uint32) []byte {
+	b := make([]byte, 4*len(v))
+	for i, x := range v {
+		binary.BigEndian.PutUint32(b[i*4:], x)
+	}
+	return b
+}
+
+func testMoov() []byte {
+	tkhd := testBox("tkhd", testU32(0, 0, 0, 1, 0))
+	mdhd := testBox("mdhd", testU32(0, 0, 0, 90000, 0))
+	hdlr := testBox("hdlr", testU32(0, 0), []byte("vide"))
+	return testBox("moov",
+		testBox("trak", tkhd, testBox("mdia", mdhd, hdlr)),
+		testBox("mvex", testBox("trex", testU32(0, 1, 1, 3000, 0, 0))),
+	)
+}
+
+// testMoof returns movie fragment of track 1 with two samples of 1s and 0.5s,
+// the first one is sync sample of 60 bytes
+func testMoof(seq uint32, flags uint32) []byte {
+	trun := testBox("trun", testU32(0x000305, 2, 8, flags, 90000, 60, 45000, 40))
+	traf := testBox("traf", testBox("tfhd", testU32(0x020000, 1)), testBox("tfdt", testU32(0, 0)), trun)
+	return testBox("moof", testBox("mfhd", testU32(0, seq)), traf)
+}
+
+// testFragmentedMP4 returns fragmented MP4 with n fragments, its init size and fragment sizes
+func testFragmentedMP4(n int, sidx bool) ([]byte, int64, []int64) {
+	file := append(testBox("ftyp", []byte("isom")), testMoov()...)
+	initSize := int64(len(file))
+	frags := []byte{}
+	sizes := []int64{}
+	for i := 0; i < n; i++ {
+		f := append(testMoof(uint32(i+1), 0x02000000), testBox("mdat", make([]byte, 100))...)
+		sizes = append(sizes, int64(len(f)))
+		frags = append(frags, f...)
+	}
+	if sidx {
+		p := testU32(0, 1, 90000, 0, 0, uint32(n))
+		for _, sz := range sizes {
+			p = append(p, testU32(uint32(sz), 135000, 0x90000000)...)
+		}
+		file = append(file, testBox("sidx", p)...)
+	}
+	return append(file, frags...), initSize, sizes
+}
+
+func TestParseMP4Moov(t *testing.T) {
+	tracks := parseMP4Moov(testMoov()[8:])
+	want := []*mp4Track{{id: 1, timescale: 90000, handler: "vide", defaultDuration: 3000}}
+	if !reflect.DeepEqual(tracks, want) {
+		t.Errorf("parseMP4Moov() = %+v, want %+v", tracks[0], want[0])
+	}
+}
+
+func TestParseMP4Index(t *testing.T) {
+	tests := []struct {
+		name      string
+		fragments int
+		sidx      bool
+	}{
+		{"moof", 3, false},
+		{"sidx", 3, true},
+		{"single moof", 1, false},
+	}
+	for _, tt := range tests {
+		file, initSize, sizes := testFragmentedMP4(tt.fragments, tt.sidx)
+		idx, err := parseMP4Index(bytes.NewReader(file))
+		if err != nil {
+			t.Fatalf("%v: %v", tt.name, err)
+		}
+		if idx.initSize != initSize {
+			t.Errorf("%v: initSize = %v, want %v", tt.name, idx.initSize, initSize)
+		}
+		if len(idx.fragments) != len(sizes) {
+			t.Fatalf("%v: got %v fragments, want %v", tt.name, len(idx.fragments), len(sizes))
+		}
+		offset := int64(len(file))
+		for _, sz := range sizes {
+			offset -= sz
+		}
+		for i, f := range idx.fragments {
+			if f.offset != offset || f.size != sizes[i] || f.duration != 1.5 {
+				t.Errorf("%v: fragment %v = %+v, want offset=%v size=%v duration=1.5", tt.name, i, f, offset, sizes[i])
+			}
+			offset += sizes[i]
+		}
+	}
+}
+
+func TestParseMP4IndexErrors(t *testing.T) {
+	file, _, _ := testFragmentedMP4(1, false)
+	tests := []struct {
+		name string
+		data []byte
+	}{
+		{"empty", []byte{}},
+		{"not fragmented", append(testBox("ftyp", []byte("isom")), testMoov()...)},
+		{"moof before moov", append(testBox("ftyp", []byte("isom")), testMoof(1, 0)...)},
+		{"invalid box size", append(testBox("ftyp", []byte("isom")), testU32(4, 0x6d6f6f76)...)},
+		{"truncated", file[:len(file)-50]},
+	}
+	for _, tt := range tests {
+		if _, err := parseMP4Index(bytes.NewReader(tt.data)); err == nil {
+			t.Errorf("%v: parseMP4Index() error = nil", tt.name)
+		}
+	}
+}
+
+func TestParseMP4IndexRanged(t *testing.T) {
+	tests := []struct {
+		name        string
+		sidx        bool
+		maxRequests int
+	}{
+		{"sidx is read from the first chunk", true, 1},
+		{"moof boxes are followed by their sizes", false, 4},
+	}
+	for _, tt := range tests {
+		file, _, _ := testFragmentedMP4(3, tt.sidx)
+		file = append(file, testBox("mdat", make([]byte, 10000))...)
+		requests := 0
+		fetched := int64(0)
+		r := newRangeReader(context.Background(), int64(len(file)), 256, func(ctx context.Context, start int64, end int64) (io.ReadCloser, error) {
+			requests++
+			fetched += end - start + 1
+			return io.NopCloser(bytes.NewReader(file[start : end+1])), nil
+		})
+		idx, err := parseMP4Index(r)
+		if err != nil {
+			t.Fatalf("%v: %v", tt.name, err)
+		}
+		if len(idx.fragments) != 3 {
+			t.Errorf("%v: got %v fragments, want 3", tt.name, len(idx.fragments))
+		}
+		if requests > tt.maxRequests {
+			t.Errorf("%v: made %v range requests, want at most %v", tt.name, requests, tt.maxRequests)
+		}
+		if fetched >= 10000 {
+			t.Errorf("%v: fetched %v bytes of %v", tt.name, fetched, len(file))
+		}
+	}
+}
+
+func TestParseSidx(t *testing.T) {
+	tests := []struct {
+		name    string
+		p       []byte
+		end     int64
+		want    []*mp4Fragment
+		wantErr bool
+	}{
+		{
+			name: "version 0",
+			p:    testU32(0, 1, 1000, 0, 16, 2, 500, 2000, 0x90000000, 300, 1000, 0x90000000),
+			end:  100,
+			want: []*mp4Fragment{{offset: 116, size: 500, duration: 2}, {offset: 616, size: 300, duration: 1}},
+		},
+		{
+			name: "version 1",
+			p:    testU32(0x01000000, 1, 1000, 0, 0, 0, 0, 1, 500, 2000, 0x90000000),
+			end:  100,
+			want: []*mp4Fragment{{offset: 100, size: 500, duration: 2}},
+		},
+		{name: "hierarchical", p: testU32(0, 1, 1000, 0, 0, 1, 0x80000200, 2000, 0x90000000), wantErr: true},
+		{name: "zero timescale", p: testU32(0, 1, 0, 0, 0, 1), wantErr: true},
+		{name: "truncated references", p: testU32(0, 1, 1000, 0, 0, 2, 500, 2000, 0), wantErr: true},
+		{name: "too short", p: testU32(0, 1), wantErr: true},
+	}
+	for _, tt := range tests {
+		got, id, err := parseSidx(tt.p, tt.end)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%v: parseSidx() error = %v, wantErr %v", tt.name, err, tt.wantErr)
+			continue
+		}
+		if tt.wantErr {
+			continue
+		}
+		if id != 1 {
+			t.Errorf("%v: reference id = %v, want 1", tt.name, id)
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%v: parseSidx() = %+v, want %+v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestParseMoofKeyframe(t *testing.T) {
+	track := &mp4Track{id: 1, timescale: 90000}
+	tests := []struct {
+		name  string
+		moof  []byte
+		track *mp4Track
+		size  int64
+		sync  bool
+		found bool
+	}{
+		{"sync sample", testMoof(1, 0x02000000), track, 68, true, true},
+		{"non-sync sample", testMoof(1, 0x01010000), track, 68, false, true},
+		{"other track", testMoof(1, 0x02000000), &mp4Track{id: 2}, 0, false, false},
+	}
+	for _, tt := range tests {
+		size, sync, found := parseMoofKeyframe(tt.moof[8:], tt.track)
+		if size != tt.size || sync != tt.sync || found != tt.found {
+			t.Errorf("%v: parseMoofKeyframe() = %v, %v, %v, want %v, %v, %v", tt.name, size, sync, found, tt.size, tt.sync, tt.found)
+		}
+	}
+}
+
+func TestMakeByteRangePlaylist(t *testing.T) {
+	file, _, _ := testFragmentedMP4(2, true)
+	idx, err := parseMP4Index(bytes.NewReader(file))
+	if err != nil {
+		t.Fatal(err)
+	}
+	pl := makeByteRangePlaylist("v0.mp4", idx)
+	for _, l := range []string{
+		"#EXT-X-TARGETDURATION:2",
+		"#EXT-X-MAP:URI=\"v0.mp4\",BYTERANGE=\"" + strconv.FormatInt(idx.initSize, 10) + "@0\"",
+		"#EXT-X-BYTERANGE:" + strconv.FormatInt(idx.fragments[1].size, 10) + "@" + strconv.FormatInt(idx.fragments[1].offset, 10),
+		"#EXT-X-ENDLIST",
+	} {
+		if !strings.Contains(pl, l+"\n") {
+			t.Errorf("playlist does not contain %q:\n%v", l, pl)
+		}
+	}
+	if n := strings.Count(pl, "#EXTINF:1.500,\n#EXT-X-BYTERANGE:"); n != 2 {
+		t.Errorf("playlist has %v segments, want 2", n)
+	}
+}
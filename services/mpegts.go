@@ -0,0 +1,138 @@
+package services
+
+const tsPacketSize = 188
+
+// tsKeyframe is video access unit starting with keyframe in MPEG-TS data
+type tsKeyframe struct {
+	offset int64
+	size   int64
+	pts    int64
+}
+
+func isTSVideoStream(t byte) bool {
+	switch t {
+	case 0x01, 0x02, 0x10, 0x1B, 0x24:
+		return true
+	}
+	return false
+}
+
+// hasKeyframeNAL reports whether PES payload has H.264 IDR/SPS or HEVC IRAP/VPS/SPS NAL units
+func hasKeyframeNAL(p []byte, hevc bool) bool {
+	for i := 0; i+3 < len(p); i++ {
+		if p[i] != 0 || p[i+1] != 0 || p[i+2] != 1 {
+			continue
+		}
+		h := p[i+3]
+		if hevc {
+			t := (h >> 1) & 0x3f
+			if (t >= 16 && t <= 21) || t == 32 || t == 33 {
+				return true
+			}
+		} else {
+			t := h & 0x1f
+			if t == 5 || t == 7 {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// parsePESPTS returns PTS of PES packet or -1
+func parsePESPTS(p []byte) (int64, []byte) {
+	if len(p) < 9 || p[0] != 0 || p[1] != 0 || p[2] != 1 {
+		return -1, p
+	}
+	hl := int(p[8])
+	if len(p) < 9+hl {
+		return -1, nil
+	}
+	pts := int64(-1)
+	if p[7]&0x80 != 0 && hl >= 5 {
+		b := p[9:14]
+		pts = int64(b[0]>>1&0x07)<<30 | int64(b[1])<<22 | int64(b[2]>>1)<<15 | int64(b[3])<<7 | int64(b[4]>>1)
+	}
+	return pts, p[9+hl:]
+}
+
+// scanTSKeyframes returns keyframes of video stream and whether data starts with PAT and PMT
+func scanTSKeyframes(b []byte) ([]*tsKeyframe, bool) {
+	pmtPID, videoPID := -1, -1
+	hevc := false
+	res := []*tsKeyframe{}
+	var cur *tsKeyframe
+	tables := 0
+	for off := 0; off+tsPacketSize <= len(b); off += tsPacketSize {
+		p := b[off : off+tsPacketSize]
+		if p[0] != 0x47 {
+			break
+		}
+		pid := int(p[1]&0x1f)<<8 | int(p[2])
+		pusi := p[1]&0x40 != 0
+		afc := (p[3] >> 4) & 0x03
+		start := 4
+		rai := false
+		if afc&0x02 != 0 {
+			l := int(p[4])
+			if l > 0 && 5 < len(p) {
+				rai = p[5]&0x40 != 0
+			}
+			start = 5 + l
+		}
+		if afc&0x01 == 0 || start >= len(p) {
+			continue
+		}
+		payload := p[start:]
+		if off == tables*tsPacketSize && (pid == 0 || pid == pmtPID) {
+			tables++
+		}
+		switch {
+		case pid == 0 && pusi:
+			if len(payload) < 1 || len(payload) < 1+int(payload[0])+8 {
+				continue
+			}
+			t := payload[1+int(payload[0]):]
+			sl := int(t[1]&0x0f)<<8 | int(t[2])
+			for i := 8; i+4 <= len(t) && i+4 <= 3+sl-4; i += 4 {
+				if t[i] != 0 || t[i+1] != 0 {
+					pmtPID = int(t[i+2]&0x1f)<<8 | int(t[i+3])
+					break
+				}
+			}
+		case pid == pmtPID && pusi && videoPID < 0:
+			if len(payload) < 1 || len(payload) < 1+int(payload[0])+12 {
+				continue
+			}
+			t := payload[1+int(payload[0]):]
+			sl := int(t[1]&0x0f)<<8 | int(t[2])
+			end := 3 + sl - 4
+			if end > len(t) {
+				end = len(t)
+			}
+			i := 12 + (int(t[10]&0x0f)<<8 | int(t[11]))
+			for ; i+5 <= end; i += 5 + (int(t[i+3]&0x0f)<<8 | int(t[i+4])) {
+				if isTSVideoStream(t[i]) {
+					videoPID = int(t[i+1]&0x1f)<<8 | int(t[i+2])
+					hevc = t[i] == 0x24
+					break
+				}
+			}
+		case pid == videoPID && pusi:
+			if cur != nil {
+				cur.size = int64(off) - cur.offset
+				res = append(res, cur)
+				cur = nil
+			}
+			pts, es := parsePESPTS(payload)
+			if rai || hasKeyframeNAL(es, hevc) {
+				cur = &tsKeyframe{offset: int64(off), pts: pts}
+			}
+		}
+	}
+	if cur != nil {
+		cur.size = int64(len(b)/tsPacketSize*tsPacketSize) - cur.offset
+		res = append(res, cur)
+	}
+	return res, tables >= 2
+}
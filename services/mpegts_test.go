@@ -0,0 +1,197 @@
+package services
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+)
+
+const (
+	testPMTPID   = 0x1000
+	testVideoPID = 0x100
+	testAudioPID = 0x101
+)
+
+// testTSPacket returns TS packet with payload padded by adaptation field stuffing
+func testTSPacket(pid int, pusi bool, rai bool, payload []byte) []byte {
+	p := []byte{0x47, byte(pid>>8) & 0x1f, byte(pid), 0x30}
+	if pusi {
+		p[1] |= 0x40
+	}
+	l := tsPacketSize - 5 - len(payload)
+	af := bytes.Repeat([]byte{0xff}, l)
+	if l > 0 {
+		af[0] = 0
+		if rai {
+			af[0] = 0x40
+		}
+	}
+	p = append(p, byte(l))
+	p = append(p, af...)
+	return append(p, payload...)
+}
+
+func testPAT() []byte {
+	return testTSPacket(0, true, false, []byte{
+		0, 0x00, 0xb0, 13, 0, 1, 0xc1, 0, 0,
+		0, 1, 0xe0 | testPMTPID>>8, testPMTPID & 0xff,
+		0, 0, 0, 0,
+	})
+}
+
+func testPMT(videoType byte) []byte {
+	return testTSPacket(testPMTPID, true, false, []byte{
+		0, 0x02, 0xb0, 23, 0, 1, 0xc1, 0, 0,
+		0xe0 | testVideoPID>>8, testVideoPID & 0xff, 0xf0, 0,
+		0x0f, 0xe0 | testAudioPID>>8, testAudioPID & 0xff, 0xf0, 0,
+		videoType, 0xe0 | testVideoPID>>8, testVideoPID & 0xff, 0xf0, 0,
+		0, 0, 0, 0,
+	})
+}
+
+func testPTS(pts int64) []byte {
+	return []byte{
+		0x21 | byte(pts>>29)&0x0e,
+		byte(pts >> 22),
+		byte(pts>>14) | 1,
+		byte(pts >> 7),
+		byte(pts<<1) | 1,
+	}
+}
+
+func testPES(pts int64, es ...byte) []byte {
+	p := []byte{0, 0, 1, 0xe0, 0, 0, 0x80, 0x80, 5}
+	p = append(p, testPTS(pts)...)
+	return append(p, es...)
+}
+
+var (
+	testIDR    = []byte{0, 0, 0, 1, 0x65, 0x88}
+	testNonIDR = []byte{0, 0, 0, 1, 0x41, 0x9a}
+)
+
+// testTS returns H.264 transport stream with PAT, PMT and video PES packets
+// with IDR at 3000, non-IDR at 6000 and random access indicated frame at 9000
+func testTS() []byte {
+	return bytes.Join([][]byte{
+		testPAT(),
+		testPMT(0x1b),
+		testTSPacket(testVideoPID, true, false, testPES(3000, testIDR...)),
+		testTSPacket(testVideoPID, false, false, []byte{1, 2, 3}),
+		testTSPacket(testAudioPID, true, false, []byte{0, 0, 1, 0xc0}),
+		testTSPacket(testVideoPID, true, false, testPES(6000, testNonIDR...)),
+		testTSPacket(testVideoPID, true, true, testPES(9000, testNonIDR...)),
+		testTSPacket(testVideoPID, false, false, []byte{4, 5, 6}),
+	}, nil)
+}
+
+func TestScanTSKeyframes(t *testing.T) {
+	ts := testTS()
+	tests := []struct {
+		name   string
+		data   []byte
+		want   []*tsKeyframe
+		tables bool
+	}{
+		{
+			name: "keyframes",
+			data: ts,
+			want: []*tsKeyframe{
+				{offset: 2 * tsPacketSize, size: 3 * tsPacketSize, pts: 3000},
+				{offset: 6 * tsPacketSize, size: 2 * tsPacketSize, pts: 9000},
+			},
+			tables: true,
+		},
+		{
+			name:   "trailing partial packet is ignored",
+			data:   ts[:len(ts)-10],
+			want:   []*tsKeyframe{{offset: 2 * tsPacketSize, size: 3 * tsPacketSize, pts: 3000}, {offset: 6 * tsPacketSize, size: tsPacketSize, pts: 9000}},
+			tables: true,
+		},
+		{
+			name: "no tables",
+			data: ts[2*tsPacketSize:],
+			want: []*tsKeyframe{},
+		},
+		{
+			name:   "lost sync",
+			data:   append(ts[:3*tsPacketSize:3*tsPacketSize], bytes.Repeat([]byte{0}, tsPacketSize)...),
+			want:   []*tsKeyframe{{offset: 2 * tsPacketSize, size: 2 * tsPacketSize, pts: 3000}},
+			tables: true,
+		},
+		{
+			name: "empty",
+			data: nil,
+			want: []*tsKeyframe{},
+		},
+	}
+	for _, tt := range tests {
+		kf, tables := scanTSKeyframes(tt.data)
+		if !reflect.DeepEqual(kf, tt.want) {
+			t.Errorf("%v: keyframes = %+v, want %+v", tt.name, kf, tt.want)
+		}
+		if tables != tt.tables {
+			t.Errorf("%v: tables = %v, want %v", tt.name, tables, tt.tables)
+		}
+	}
+}
+
+func TestScanTSKeyframesHEVC(t *testing.T) {
+	data := bytes.Join([][]byte{
+		testPAT(),
+		testPMT(0x24),
+		testTSPacket(testVideoPID, true, false, testPES(0, 0, 0, 1, 0x02, 0x01)),
+		testTSPacket(testVideoPID, true, false, testPES(3000, 0, 0, 1, 0x26, 0x01)),
+	}, nil)
+	kf, _ := scanTSKeyframes(data)
+	want := []*tsKeyframe{{offset: 3 * tsPacketSize, size: tsPacketSize, pts: 3000}}
+	if !reflect.DeepEqual(kf, want) {
+		t.Errorf("keyframes = %+v, want %+v", kf, want)
+	}
+}
+
+func TestHasKeyframeNAL(t *testing.T) {
+	tests := []struct {
+		name string
+		p    []byte
+		hevc bool
+		want bool
+	}{
+		{"h264 idr", []byte{0, 0, 0, 1, 0x65}, false, true},
+		{"h264 sps", []byte{0, 0, 1, 0x67}, false, true},
+		{"h264 non-idr", []byte{0, 0, 1, 0x41}, false, false},
+		{"h264 aud then idr", []byte{0, 0, 1, 0x09, 0xf0, 0, 0, 1, 0x65}, false, true},
+		{"hevc idr", []byte{0, 0, 1, 0x26, 0x01}, true, true},
+		{"hevc cra", []byte{0, 0, 1, 0x2a, 0x01}, true, true},
+		{"hevc vps", []byte{0, 0, 1, 0x40, 0x01}, true, true},
+		{"hevc trail", []byte{0, 0, 1, 0x02, 0x01}, true, false},
+		{"no start code", []byte{0, 1, 0x65, 0x65}, false, false},
+		{"empty", nil, false, false},
+	}
+	for _, tt := range tests {
+		if got := hasKeyframeNAL(tt.p, tt.hevc); got != tt.want {
+			t.Errorf("%v: hasKeyframeNAL() = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestParsePESPTS(t *testing.T) {
+	tests := []struct {
+		name string
+		p    []byte
+		pts  int64
+		es   []byte
+	}{
+		{"pts", testPES(3000, 0xaa), 3000, []byte{0xaa}},
+		{"33-bit pts", testPES(1<<32+5, 0xaa), 1<<32 + 5, []byte{0xaa}},
+		{"no pts", []byte{0, 0, 1, 0xe0, 0, 0, 0x80, 0, 0, 0xaa}, -1, []byte{0xaa}},
+		{"not pes", []byte{0xaa, 0xbb}, -1, []byte{0xaa, 0xbb}},
+		{"truncated header", []byte{0, 0, 1, 0xe0, 0, 0, 0x80, 0x80, 5, 0}, -1, nil},
+	}
+	for _, tt := range tests {
+		pts, es := parsePESPTS(tt.p)
+		if pts != tt.pts || !bytes.Equal(es, tt.es) {
+			t.Errorf("%v: parsePESPTS() = %v, %x, want %v, %x", tt.name, pts, es, tt.pts, tt.es)
+		}
+	}
+}
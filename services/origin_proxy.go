@@ -0,0 +1,149 @@
+package services
+
+import (
+	"context"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"regexp"
+	"strings"
+
+	"github.com/pkg/errors"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/urfave/cli"
+)
+
+const (
+	originURLTemplateFlag = "origin-url-template"
+)
+
+var originPlaceholders = []string{"{prefix}", "{hash}", "{origin_path}", "{path}", "{query}"}
+
+func RegisterOriginProxyFlags(c *cli.App) {
+	c.Flags = append(c.Flags, cli.StringFlag{
+		Name: originURLTemplateFlag,
+		Usage: "live transcoder URL template used while content is not in storage, " +
+			"supports {prefix}, {hash}, {origin_path}, {path} and {query} placeholders",
+		Value:  "",
+		EnvVar: "ORIGIN_URL_TEMPLATE",
+	})
+}
+
+// OriginProxy proxies requests to live transcoder until transcoding is done
+type OriginProxy struct {
+	tpl    string
+	hostRe *regexp.Regexp
+	rp     *httputil.ReverseProxy
+}
+
+type originProxyContextKey struct{}
+
+func NewOriginProxy(c *cli.Context, cl *http.Client) *OriginProxy {
+	s := &OriginProxy{
+		tpl: c.String(originURLTemplateFlag),
+	}
+	s.hostRe = originHostRe(s.tpl)
+	s.rp = &httputil.ReverseProxy{
+		Director: func(r *http.Request) {
+			u := r.Context().Value(originProxyContextKey{}).(*url.URL)
+			r.URL = u
+			r.Host = u.Host
+			// let transport decompress upstream response, so playlists can be rewritten
+			r.Header.Del("Accept-Encoding")
+			r.Header.Del("If-None-Match")
+			r.Header.Del("If-Modified-Since")
+		},
+		Transport:     cl.Transport,
+		FlushInterval: -1,
+		ModifyResponse: func(res *http.Response) error {
+			res.Header.Del("ETag")
+			res.Header.Del("Last-Modified")
+			res.Header.Del("Cache-Control")
+			return nil
+		},
+		ErrorHandler: func(w http.ResponseWriter, r *http.Request, err error) {
+			log.WithError(err).Error("failed to proxy request to origin")
+			writeAPIError(w, http.StatusBadGateway, &APIError{
+				Code:       ErrCodeOriginUnavailable,
+				Message:    "origin is unavailable",
+				RetryAfter: storageRetryAfter,
+			})
+		},
+	}
+	return s
+}
+
+func (s *OriginProxy) Enabled() bool {
+	return s.tpl != ""
+}
+
+// escapePath escapes every segment of path, dot segments are rejected
+func escapePath(p string) (string, error) {
+	ss := strings.Split(strings.TrimPrefix(p, "/"), "/")
+	for i, seg := range ss {
+		if seg == ".." || seg == "." {
+			return "", errors.Errorf("dot segment in path=%v", p)
+		}
+		ss[i] = url.PathEscape(seg)
+	}
+	return strings.Join(ss, "/"), nil
+}
+
+// originHostRe matches hosts the template can produce, placeholders
+// in host part are limited to single DNS label
+func originHostRe(tpl string) *regexp.Regexp {
+	h := tpl
+	if i := strings.Index(h, "://"); i >= 0 {
+		h = h[i+3:]
+	}
+	if i := strings.IndexAny(h, "/?#"); i >= 0 {
+		h = h[:i]
+	}
+	h = regexp.QuoteMeta(h)
+	for _, p := range originPlaceholders {
+		h = strings.ReplaceAll(h, regexp.QuoteMeta(p), `[A-Za-z0-9-]+`)
+	}
+	return regexp.MustCompile("^" + h + "$")
+}
+
+func (s *OriginProxy) makeURL(prefix string, hash string, originPath string, r *http.Request) (*url.URL, error) {
+	op, err := escapePath(originPath)
+	if err != nil {
+		return nil, err
+	}
+	p, err := escapePath(r.URL.Path)
+	if err != nil {
+		return nil, err
+	}
+	if strings.Contains(prefix, "..") {
+		return nil, errors.Errorf("dot segment in prefix=%v", prefix)
+	}
+	u, err := url.Parse(strings.NewReplacer(
+		"{prefix}", url.PathEscape(prefix),
+		"{hash}", url.PathEscape(hash),
+		"{origin_path}", op,
+		"{path}", p,
+		"{query}", r.URL.RawQuery,
+	).Replace(s.tpl))
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to parse origin url")
+	}
+	if u.User != nil || !s.hostRe.MatchString(u.Host) {
+		return nil, errors.Errorf("origin host does not match template host=%v", u.Host)
+	}
+	return u, nil
+}
+
+// Proxy streams response of the live transcoder back to the client
+func (s *OriginProxy) Proxy(w http.ResponseWriter, r *http.Request, prefix string, hash string, originPath string) {
+	u, err := s.makeURL(prefix, hash, originPath, r)
+	if err != nil {
+		log.WithError(err).Warn("failed to make origin url")
+		writeInvalidRequest(w)
+		return
+	}
+	log.Infof("proxying request to origin url=%v", u)
+	r = r.WithContext(context.WithValue(r.Context(), originProxyContextKey{}, u))
+	s.rp.ServeHTTP(w, r)
+}
@@ -0,0 +1,231 @@
+package services
+
+import (
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	maxHeightParam    = "maxHeight"
+	maxBandwidthParam = "maxBandwidth"
+	codecsParam       = "codecs"
+	audioLangParam    = "audioLang"
+)
+
+var playlistFilterParams = []string{maxHeightParam, maxBandwidthParam, codecsParam, audioLangParam}
+
+// playlistFilter drops master playlist variants and media entries
+// that do not match query parameters
+type playlistFilter struct {
+	maxHeight    int
+	maxBandwidth int64
+	codecs       []string
+	audioLang    []string
+}
+
+// newPlaylistFilter returns nil if no filter parameters were provided
+func newPlaylistFilter(q url.Values) (*playlistFilter, error) {
+	f := &playlistFilter{}
+	set := false
+	if v := q.Get(maxHeightParam); v != "" {
+		h, err := strconv.Atoi(v)
+		if err != nil || h <= 0 {
+			return nil, errors.Errorf("invalid %v=%v", maxHeightParam, v)
+		}
+		f.maxHeight = h
+		set = true
+	}
+	if v := q.Get(maxBandwidthParam); v != "" {
+		b, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || b <= 0 {
+			return nil, errors.Errorf("invalid %v=%v", maxBandwidthParam, v)
+		}
+		f.maxBandwidth = b
+		set = true
+	}
+	if v := q.Get(codecsParam); v != "" {
+		f.codecs = splitList(strings.ToLower(v))
+		set = true
+	}
+	if v := q.Get(audioLangParam); v != "" {
+		f.audioLang = splitList(strings.ToLower(v))
+		set = true
+	}
+	if !set {
+		return nil, nil
+	}
+	return f, nil
+}
+
+// stripPlaylistFilterParams removes filter parameters from raw query,
+// so they are not propagated to segment URIs
+func stripPlaylistFilterParams(rawQuery string) string {
+	if rawQuery == "" {
+		return ""
+	}
+	parts := []string{}
+	for _, p := range strings.Split(rawQuery, "&") {
+		name := p
+		if i := strings.Index(p, "="); i >= 0 {
+			name = p[:i]
+		}
+		skip := false
+		for _, fp := range playlistFilterParams {
+			if name == fp {
+				skip = true
+				break
+			}
+		}
+		if !skip && p != "" {
+			parts = append(parts, p)
+		}
+	}
+	return strings.Join(parts, "&")
+}
+
+// parseAttributes parses attribute list of HLS tag
+func parseAttributes(line string) map[string]string {
+	res := map[string]string{}
+	i := strings.Index(line, ":")
+	if i < 0 {
+		return res
+	}
+	s := line[i+1:]
+	for len(s) > 0 {
+		eq := strings.Index(s, "=")
+		if eq < 0 {
+			break
+		}
+		name := strings.TrimSpace(s[:eq])
+		s = s[eq+1:]
+		var val string
+		if strings.HasPrefix(s, `"`) {
+			end := strings.Index(s[1:], `"`)
+			if end < 0 {
+				val = s[1:]
+				s = ""
+			} else {
+				val = s[1 : end+1]
+				s = s[end+2:]
+			}
+			if c := strings.Index(s, ","); c >= 0 {
+				s = s[c+1:]
+			} else {
+				s = ""
+			}
+		} else if c := strings.Index(s, ","); c >= 0 {
+			val = s[:c]
+			s = s[c+1:]
+		} else {
+			val = s
+			s = ""
+		}
+		res[name] = val
+	}
+	return res
+}
+
+func isMasterPlaylist(lines []string) bool {
+	for _, l := range lines {
+		if strings.HasPrefix(l, "#EXT-X-STREAM-INF") {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *playlistFilter) matchVariant(attrs map[string]string) bool {
+	if s.maxHeight > 0 {
+		if res := attrs["RESOLUTION"]; res != "" {
+			parts := strings.SplitN(strings.ToLower(res), "x", 2)
+			if len(parts) == 2 {
+				if h, err := strconv.Atoi(parts[1]); err == nil && h > s.maxHeight {
+					return false
+				}
+			}
+		}
+	}
+	if s.maxBandwidth > 0 {
+		if b, err := strconv.ParseInt(attrs["BANDWIDTH"], 10, 64); err == nil && b > s.maxBandwidth {
+			return false
+		}
+	}
+	if len(s.codecs) > 0 && attrs["CODECS"] != "" {
+		for _, c := range splitList(strings.ToLower(attrs["CODECS"])) {
+			ok := false
+			for _, a := range s.codecs {
+				if strings.HasPrefix(c, a) {
+					ok = true
+					break
+				}
+			}
+			if !ok {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+func (s *playlistFilter) matchMedia(attrs map[string]string) bool {
+	if attrs["TYPE"] != "AUDIO" || len(s.audioLang) == 0 {
+		return true
+	}
+	lang := strings.ToLower(attrs["LANGUAGE"])
+	for _, l := range s.audioLang {
+		if lang == l || strings.HasPrefix(lang, l+"-") {
+			return true
+		}
+	}
+	return false
+}
+
+// Apply filters master playlist lines. Filters that would leave no
+// variant or empty audio group are not applied to keep playlist playable.
+func (s *playlistFilter) Apply(lines []string) []string {
+	variants := 0
+	matched := 0
+	groups := map[string]int{}
+	for _, l := range lines {
+		if strings.HasPrefix(l, "#EXT-X-STREAM-INF") {
+			variants++
+			if s.matchVariant(parseAttributes(l)) {
+				matched++
+			}
+		} else if strings.HasPrefix(l, "#EXT-X-MEDIA:") {
+			attrs := parseAttributes(l)
+			if s.matchMedia(attrs) {
+				groups[attrs["GROUP-ID"]]++
+			}
+		}
+	}
+	keepVariants := variants > 0 && matched == 0
+	res := make([]string, 0, len(lines))
+	skipURI := false
+	for _, l := range lines {
+		switch {
+		case skipURI && l != "" && !strings.HasPrefix(l, "#"):
+			skipURI = false
+			continue
+		case strings.HasPrefix(l, "#EXT-X-STREAM-INF"):
+			if !keepVariants && !s.matchVariant(parseAttributes(l)) {
+				skipURI = true
+				continue
+			}
+		case strings.HasPrefix(l, "#EXT-X-I-FRAME-STREAM-INF"):
+			if !keepVariants && !s.matchVariant(parseAttributes(l)) {
+				continue
+			}
+		case strings.HasPrefix(l, "#EXT-X-MEDIA:"):
+			attrs := parseAttributes(l)
+			if groups[attrs["GROUP-ID"]] > 0 && !s.matchMedia(attrs) {
+				continue
+			}
+		}
+		res = append(res, l)
+	}
+	return res
+}
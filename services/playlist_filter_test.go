@@ -0,0 +1,158 @@
+package services
+
+import (
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+const testMasterPlaylist = `#EXTM3U
+#EXT-X-MEDIA:TYPE=AUDIO,GROUP-ID="aud",NAME="English",LANGUAGE="en-US",URI="a0.m3u8"
+#EXT-X-MEDIA:TYPE=AUDIO,GROUP-ID="aud",NAME="Russian",LANGUAGE="ru",URI="a1.m3u8"
+#EXT-X-MEDIA:TYPE=SUBTITLES,GROUP-ID="sub",NAME="English",LANGUAGE="en",URI="s0.m3u8"
+#EXT-X-STREAM-INF:BANDWIDTH=800000,RESOLUTION=640x360,CODECS="avc1.4d401e,mp4a.40.2",AUDIO="aud"
+v0.m3u8
+#EXT-X-STREAM-INF:BANDWIDTH=2500000,RESOLUTION=1280x720,CODECS="avc1.4d401f,mp4a.40.2",AUDIO="aud"
+v1.m3u8
+#EXT-X-STREAM-INF:BANDWIDTH=6000000,RESOLUTION=1920x1080,CODECS="hvc1.1.6.L120.90,mp4a.40.2",AUDIO="aud"
+v2.m3u8
+#EXT-X-I-FRAME-STREAM-INF:BANDWIDTH=90000,RESOLUTION=1920x1080,CODECS="hvc1.1.6.L120.90",URI="v2-iframes.m3u8"
+`
+
+func TestNewPlaylistFilter(t *testing.T) {
+	tests := []struct {
+		query   string
+		want    *playlistFilter
+		wantErr bool
+	}{
+		{"", nil, false},
+		{"token=abc", nil, false},
+		{"maxHeight=720", &playlistFilter{maxHeight: 720}, false},
+		{"maxBandwidth=3000000&codecs=AVC1,mp4a", &playlistFilter{maxBandwidth: 3000000, codecs: []string{"avc1", "mp4a"}}, false},
+		{"audioLang=en,%20RU", &playlistFilter{audioLang: []string{"en", "ru"}}, false},
+		{"maxHeight=abc", nil, true},
+		{"maxHeight=0", nil, true},
+		{"maxBandwidth=-1", nil, true},
+	}
+	for _, tt := range tests {
+		q, _ := url.ParseQuery(tt.query)
+		got, err := newPlaylistFilter(q)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("newPlaylistFilter(%q) error = %v, wantErr %v", tt.query, err, tt.wantErr)
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("newPlaylistFilter(%q) = %+v, want %+v", tt.query, got, tt.want)
+		}
+	}
+}
+
+func TestStripPlaylistFilterParams(t *testing.T) {
+	tests := []struct {
+		in   string
+		want string
+	}{
+		{"", ""},
+		{"token=abc", "token=abc"},
+		{"maxHeight=720&token=abc&codecs=avc1", "token=abc"},
+		{"audioLang=en&maxBandwidth=1&&b=2", "b=2"},
+		{"maxHeightX=1&codecs", "maxHeightX=1"},
+	}
+	for _, tt := range tests {
+		if got := stripPlaylistFilterParams(tt.in); got != tt.want {
+			t.Errorf("stripPlaylistFilterParams(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestParseAttributes(t *testing.T) {
+	tests := []struct {
+		in   string
+		want map[string]string
+	}{
+		{"#EXTM3U", map[string]string{}},
+		{
+			`#EXT-X-STREAM-INF:BANDWIDTH=800000,CODECS="avc1.4d401e,mp4a.40.2",RESOLUTION=640x360`,
+			map[string]string{"BANDWIDTH": "800000", "CODECS": "avc1.4d401e,mp4a.40.2", "RESOLUTION": "640x360"},
+		},
+		{
+			`#EXT-X-MEDIA:TYPE=AUDIO, NAME="a=b",LANGUAGE="en`,
+			map[string]string{"TYPE": "AUDIO", "NAME": "a=b", "LANGUAGE": "en"},
+		},
+	}
+	for _, tt := range tests {
+		if got := parseAttributes(tt.in); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("parseAttributes(%q) = %v, want %v", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestPlaylistFilterApply(t *testing.T) {
+	tests := []struct {
+		name     string
+		query    string
+		variants []string
+		audio    []string
+		iframes  bool
+	}{
+		{"max height", "maxHeight=720", []string{"v0.m3u8", "v1.m3u8"}, []string{"a0.m3u8", "a1.m3u8"}, false},
+		{"max bandwidth applies to i-frame bandwidth", "maxBandwidth=1000000", []string{"v0.m3u8"}, []string{"a0.m3u8", "a1.m3u8"}, true},
+		{"codecs", "codecs=hvc1,mp4a", []string{"v2.m3u8"}, []string{"a0.m3u8", "a1.m3u8"}, true},
+		{"codecs missing audio codec", "codecs=avc1", []string{"v0.m3u8", "v1.m3u8", "v2.m3u8"}, []string{"a0.m3u8", "a1.m3u8"}, true},
+		{"nothing matches keeps all variants", "maxHeight=100", []string{"v0.m3u8", "v1.m3u8", "v2.m3u8"}, []string{"a0.m3u8", "a1.m3u8"}, true},
+		{"audio language prefix", "audioLang=en", []string{"v0.m3u8", "v1.m3u8", "v2.m3u8"}, []string{"a0.m3u8"}, true},
+		{"audio language exact", "audioLang=ru", []string{"v0.m3u8", "v1.m3u8", "v2.m3u8"}, []string{"a1.m3u8"}, true},
+		{"unknown language keeps group", "audioLang=fr", []string{"v0.m3u8", "v1.m3u8", "v2.m3u8"}, []string{"a0.m3u8", "a1.m3u8"}, true},
+	}
+	lines := strings.Split(testMasterPlaylist, "\n")
+	if !isMasterPlaylist(lines) {
+		t.Fatal("isMasterPlaylist() = false for master playlist")
+	}
+	for _, tt := range tests {
+		q, _ := url.ParseQuery(tt.query)
+		f, err := newPlaylistFilter(q)
+		if err != nil {
+			t.Fatalf("%v: %v", tt.name, err)
+		}
+		res := f.Apply(lines)
+		variants := []string{}
+		audio := []string{}
+		iframes := false
+		subtitles := false
+		for i, l := range res {
+			switch {
+			case strings.HasPrefix(l, "#EXT-X-STREAM-INF"):
+				variants = append(variants, res[i+1])
+			case strings.HasPrefix(l, "#EXT-X-I-FRAME-STREAM-INF"):
+				iframes = true
+			case strings.HasPrefix(l, "#EXT-X-MEDIA:"):
+				attrs := parseAttributes(l)
+				if attrs["TYPE"] == "AUDIO" {
+					audio = append(audio, attrs["URI"])
+				} else {
+					subtitles = true
+				}
+			}
+		}
+		if !reflect.DeepEqual(variants, tt.variants) {
+			t.Errorf("%v: variants = %v, want %v", tt.name, variants, tt.variants)
+		}
+		if !reflect.DeepEqual(audio, tt.audio) {
+			t.Errorf("%v: audio = %v, want %v", tt.name, audio, tt.audio)
+		}
+		if iframes != tt.iframes {
+			t.Errorf("%v: iframes = %v, want %v", tt.name, iframes, tt.iframes)
+		}
+		if !subtitles {
+			t.Errorf("%v: subtitles were dropped", tt.name)
+		}
+	}
+}
+
+func TestIsMasterPlaylist(t *testing.T) {
+	media := "#EXTM3U\n#EXT-X-TARGETDURATION:4\n#EXTINF:4.000,\nv0-0.ts\n#EXT-X-ENDLIST\n"
+	if isMasterPlaylist(strings.Split(media, "\n")) {
+		t.Error("isMasterPlaylist() = true for media playlist")
+	}
+}
@@ -0,0 +1,151 @@
+package services
+
+import (
+	"context"
+	"io"
+	"time"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"github.com/urfave/cli"
+)
+
+const (
+	prewarmIntervalFlag = "prewarm-interval"
+	prewarmTopFlag      = "prewarm-top"
+	prewarmSegmentsFlag = "prewarm-segments"
+	prewarmWindow       = time.Hour
+	prewarmTimeout      = 60 * time.Second
+)
+
+func RegisterPrewarmerFlags(c *cli.App) {
+	c.Flags = append(c.Flags, cli.DurationFlag{
+		Name:   prewarmIntervalFlag,
+		Usage:  "interval of pre-warming popular renditions (0 disables pre-warming)",
+		Value:  0,
+		EnvVar: "PREWARM_INTERVAL",
+	})
+	c.Flags = append(c.Flags, cli.IntFlag{
+		Name:   prewarmTopFlag,
+		Usage:  "number of most popular renditions to pre-warm",
+		Value:  20,
+		EnvVar: "PREWARM_TOP",
+	})
+	c.Flags = append(c.Flags, cli.IntFlag{
+		Name:   prewarmSegmentsFlag,
+		Usage:  "number of starting segments to pre-warm per rendition",
+		Value:  3,
+		EnvVar: "PREWARM_SEGMENTS",
+	})
+}
+
+// Prewarmer periodically preloads playlists and starting segments
+// of the most popular renditions through the active content cache
+type Prewarmer struct {
+	st       *Stats
+	ca       ContentCache
+	dp       *DonePool
+	interval time.Duration
+	top      int
+	segments int
+	closeCh  chan bool
+	doneCh   chan bool
+}
+
+func NewPrewarmer(c *cli.Context, st *Stats, ca ContentCache, dp *DonePool) *Prewarmer {
+	p := &Prewarmer{
+		st:       st,
+		ca:       ca,
+		dp:       dp,
+		interval: c.Duration(prewarmIntervalFlag),
+		top:      c.Int(prewarmTopFlag),
+		segments: c.Int(prewarmSegmentsFlag),
+		closeCh:  make(chan bool),
+		doneCh:   make(chan bool),
+	}
+	go p.run()
+	return p
+}
+
+func (s *Prewarmer) run() {
+	defer close(s.doneCh)
+	if s.interval == 0 {
+		return
+	}
+	t := time.NewTicker(s.interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+			s.prewarm()
+		case <-s.closeCh:
+			return
+		}
+	}
+}
+
+func (s *Prewarmer) prewarm() {
+	for _, e := range s.st.Top(s.top, prewarmWindow, statsByRequests, true) {
+		done, _, err := s.dp.Done(e.Key)
+		if err != nil {
+			log.WithError(err).Warnf("failed to check done marker key=%v", e.Key)
+			continue
+		}
+		if !done {
+			continue
+		}
+		paths := []string{e.path}
+		if f := NewFragment(e.path); f != nil {
+			paths = []string{}
+			for i := 0; i < s.segments; i++ {
+				paths = append(paths, f.Inc(i-f.num).String())
+			}
+		}
+		for _, p := range paths {
+			select {
+			case <-s.closeCh:
+				return
+			default:
+			}
+			err := s.warm(e.Key, p)
+			if err != nil {
+				if _, ok := err.(*NotFoundError); !ok {
+					log.WithError(err).Warnf("failed to pre-warm key=%v path=%v", e.Key, p)
+				}
+			}
+		}
+	}
+}
+
+// warm reads content through the cache, so it ends up stored
+// whether whole objects or blocks are cached
+func (s *Prewarmer) warm(key string, path string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), prewarmTimeout)
+	defer cancel()
+	go func() {
+		select {
+		case <-s.closeCh:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	r, _, err := s.ca.Get(ctx, key, path)
+	if err != nil {
+		return err
+	}
+	if r == nil {
+		return &NotFoundError{errors.Errorf("content not found key=%v path=%v", key, path)}
+	}
+	defer r.Close()
+	_, err = io.Copy(io.Discard, r)
+	return err
+}
+
+func (s *Prewarmer) Close() {
+	select {
+	case <-s.closeCh:
+	default:
+		close(s.closeCh)
+	}
+	<-s.doneCh
+}
@@ -0,0 +1,48 @@
+package services
+
+import (
+	"context"
+	"io"
+	"strings"
+	"testing"
+)
+
+type testContentCache map[string]string
+
+func (s testContentCache) Get(ctx context.Context, key string, path string) (io.ReadSeekCloser, CacheStatus, error) {
+	c, ok := s[key+path]
+	if !ok {
+		return nil, CacheStatusMiss, nil
+	}
+	return &testContent{strings.NewReader(c)}, CacheStatusMiss, nil
+}
+
+type testContent struct {
+	*strings.Reader
+}
+
+func (s *testContent) Close() error {
+	return nil
+}
+
+func TestPrewarmerWarm(t *testing.T) {
+	p := &Prewarmer{
+		ca:      testContentCache{"k/v0-0.ts": "data"},
+		closeCh: make(chan bool),
+	}
+	tests := []struct {
+		name     string
+		path     string
+		notFound bool
+	}{
+		{"existing path", "/v0-0.ts", false},
+		{"missing path", "/v0-5.ts", true},
+	}
+	for _, tt := range tests {
+		err := p.warm("k", tt.path)
+		_, notFound := err.(*NotFoundError)
+		if notFound != tt.notFound || (!tt.notFound && err != nil) {
+			t.Errorf("%v: warm() error = %v, want not found %v", tt.name, err, tt.notFound)
+		}
+	}
+}
@@ -0,0 +1,103 @@
+package services
+
+import (
+	"context"
+	"io"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	rangeReaderChunkSize = 64 * 1024
+)
+
+type rangeFetcher func(ctx context.Context, start int64, end int64) (io.ReadCloser, error)
+
+// rangeReader reads object with ranged requests, so only parts of the file
+// that are actually read get fetched. Every request fetches at least
+// chunk bytes, so small sequential reads are served from buffer.
+type rangeReader struct {
+	ctx   context.Context
+	fetch rangeFetcher
+	size  int64
+	chunk int64
+	pos   int64
+	off   int64
+	buf   []byte
+}
+
+func newRangeReader(ctx context.Context, size int64, chunk int64, fetch rangeFetcher) *rangeReader {
+	return &rangeReader{
+		ctx:   ctx,
+		fetch: fetch,
+		size:  size,
+		chunk: chunk,
+	}
+}
+
+// newS3RangeReader returns reader of S3 object, nil if object does not exist
+func newS3RangeReader(ctx context.Context, s3st *S3Storage, ci *ContentInfoCache, key string, path string) (*rangeReader, error) {
+	i, err := ci.Get(ctx, key, path)
+	if err != nil || i == nil {
+		return nil, err
+	}
+	return newRangeReader(ctx, i.Size, rangeReaderChunkSize, func(ctx context.Context, start int64, end int64) (io.ReadCloser, error) {
+		r, err := s3st.GetContentRange(ctx, key, path, start, end)
+		if err == nil && r == nil {
+			err = errors.Errorf("content disappeared key=%v path=%v", key, path)
+		}
+		return r, err
+	}), nil
+}
+
+func (s *rangeReader) Read(p []byte) (int, error) {
+	if s.pos >= s.size {
+		return 0, io.EOF
+	}
+	if s.pos < s.off || s.pos >= s.off+int64(len(s.buf)) {
+		if err := s.load(int64(len(p))); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, s.buf[s.pos-s.off:])
+	s.pos += int64(n)
+	return n, nil
+}
+
+// load fetches at least n bytes starting from current position
+func (s *rangeReader) load(n int64) error {
+	if n < s.chunk {
+		n = s.chunk
+	}
+	if s.pos+n > s.size {
+		n = s.size - s.pos
+	}
+	r, err := s.fetch(s.ctx, s.pos, s.pos+n-1)
+	if err != nil {
+		return errors.Wrapf(err, "failed to fetch range start=%v size=%v", s.pos, n)
+	}
+	defer r.Close()
+	buf := make([]byte, n)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return errors.Wrapf(err, "failed to read range start=%v size=%v", s.pos, n)
+	}
+	s.off, s.buf = s.pos, buf
+	return nil
+}
+
+func (s *rangeReader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += s.pos
+	case io.SeekEnd:
+		offset += s.size
+	default:
+		return 0, errors.Errorf("invalid whence=%v", whence)
+	}
+	if offset < 0 {
+		return 0, errors.Errorf("negative position=%v", offset)
+	}
+	s.pos = offset
+	return offset, nil
+}
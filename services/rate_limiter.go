@@ -0,0 +1,117 @@
+package services
+
+import (
+	"net/http"
+	"regexp"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/urfave/cli"
+)
+
+const (
+	requestsPerSecondFlag = "requests-per-second"
+	requestsBurstFlag     = "requests-burst"
+	rateLimiterIdle       = time.Minute
+)
+
+var infoHashRe = regexp.MustCompile(`^([0-9a-fA-F]{40}|[0-9a-fA-F]{64})$`)
+
+func RegisterRateLimiterFlags(c *cli.App) {
+	c.Flags = append(c.Flags, cli.Float64Flag{
+		Name:   requestsPerSecondFlag,
+		Usage:  "lookup requests per second per client IP (0 is unlimited)",
+		Value:  0,
+		EnvVar: "REQUESTS_PER_SECOND",
+	})
+	c.Flags = append(c.Flags, cli.IntFlag{
+		Name:   requestsBurstFlag,
+		Usage:  "burst of lookup requests per client IP",
+		Value:  100,
+		EnvVar: "REQUESTS_BURST",
+	})
+}
+
+type rateLimiterClient struct {
+	b    *tokenBucket
+	last time.Time
+}
+
+// RateLimiter limits request rate per client IP
+type RateLimiter struct {
+	mux     sync.Mutex
+	th      *Throttler
+	rate    float64
+	burst   int
+	clients map[string]*rateLimiterClient
+	swept   time.Time
+}
+
+func NewRateLimiter(c *cli.Context, th *Throttler) *RateLimiter {
+	return &RateLimiter{
+		th:      th,
+		rate:    c.Float64(requestsPerSecondFlag),
+		burst:   c.Int(requestsBurstFlag),
+		clients: map[string]*rateLimiterClient{},
+		swept:   time.Now(),
+	}
+}
+
+// sweep drops idle clients, their buckets are full anyway
+func (s *RateLimiter) sweep(now time.Time) {
+	if now.Sub(s.swept) < rateLimiterIdle {
+		return
+	}
+	s.swept = now
+	for ip, c := range s.clients {
+		if now.Sub(c.last) > rateLimiterIdle {
+			delete(s.clients, ip)
+		}
+	}
+}
+
+func (s *RateLimiter) Allow(r *http.Request) bool {
+	if s.rate == 0 {
+		return true
+	}
+	ip := s.th.ClientIP(r)
+	now := time.Now()
+	s.mux.Lock()
+	s.sweep(now)
+	c, ok := s.clients[ip]
+	if !ok {
+		c = &rateLimiterClient{
+			b: &tokenBucket{
+				rate:   s.rate,
+				burst:  float64(s.burst),
+				tokens: float64(s.burst),
+				last:   now,
+			},
+		}
+		s.clients[ip] = c
+	}
+	c.last = now
+	s.mux.Unlock()
+	if c.b.take(1) > 0 {
+		// return reserved token
+		c.b.take(-1)
+		return false
+	}
+	return true
+}
+
+func (s *RateLimiter) Handler(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !s.Allow(r) {
+			log.Warnf("request rate exceeded path=%v ip=%v", r.URL.Path, s.th.ClientIP(r))
+			writeAPIError(w, http.StatusTooManyRequests, &APIError{
+				Code:       ErrCodeRateLimited,
+				Message:    "request rate exceeded",
+				RetryAfter: 1,
+			})
+			return
+		}
+		h(w, r)
+	}
+}
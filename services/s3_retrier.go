@@ -0,0 +1,397 @@
+package services
+
+import (
+	"context"
+	"expvar"
+	"io"
+	"math"
+	"math/rand"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/client"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"github.com/urfave/cli"
+)
+
+const (
+	s3RetriesFlag          = "s3-retries"
+	s3RetryBaseDelayFlag   = "s3-retry-base-delay"
+	s3RetryMaxDelayFlag    = "s3-retry-max-delay"
+	s3HedgePercentileFlag  = "s3-hedge-percentile"
+	s3BreakerThresholdFlag = "s3-breaker-threshold"
+	s3BreakerCooldownFlag  = "s3-breaker-cooldown"
+	latencySamples         = 200
+	minLatencySamples      = 20
+)
+
+var s3Metrics = expvar.NewMap("s3")
+
+var ErrCircuitOpen = errors.New("S3 circuit breaker is open")
+
+// noSDKRetries disables retries of AWS SDK, so they are done by S3Retrier only
+var noSDKRetries request.Option = func(r *request.Request) {
+	r.Retryer = client.NoOpRetryer{}
+}
+
+func RegisterS3RetrierFlags(c *cli.App) {
+	c.Flags = append(c.Flags, cli.IntFlag{
+		Name:   s3RetriesFlag,
+		Usage:  "number of retries for retryable S3 errors",
+		Value:  3,
+		EnvVar: "S3_RETRIES",
+	})
+	c.Flags = append(c.Flags, cli.DurationFlag{
+		Name:   s3RetryBaseDelayFlag,
+		Usage:  "base delay of S3 retry backoff",
+		Value:  100 * time.Millisecond,
+		EnvVar: "S3_RETRY_BASE_DELAY",
+	})
+	c.Flags = append(c.Flags, cli.DurationFlag{
+		Name:   s3RetryMaxDelayFlag,
+		Usage:  "max delay of S3 retry backoff",
+		Value:  5 * time.Second,
+		EnvVar: "S3_RETRY_MAX_DELAY",
+	})
+	c.Flags = append(c.Flags, cli.Float64Flag{
+		Name:   s3HedgePercentileFlag,
+		Usage:  "latency percentile after which hedged S3 read is sent (0 disables hedging)",
+		Value:  0,
+		EnvVar: "S3_HEDGE_PERCENTILE",
+	})
+	c.Flags = append(c.Flags, cli.IntFlag{
+		Name:   s3BreakerThresholdFlag,
+		Usage:  "consecutive S3 failures that open circuit breaker (0 disables breaker)",
+		Value:  10,
+		EnvVar: "S3_BREAKER_THRESHOLD",
+	})
+	c.Flags = append(c.Flags, cli.DurationFlag{
+		Name:   s3BreakerCooldownFlag,
+		Usage:  "time circuit breaker stays open",
+		Value:  10 * time.Second,
+		EnvVar: "S3_BREAKER_COOLDOWN",
+	})
+}
+
+// S3Retrier retries S3 calls with jittered exponential backoff,
+// hedges slow reads and fails fast while backend is down
+type S3Retrier struct {
+	retries   int
+	baseDelay time.Duration
+	maxDelay  time.Duration
+	hedgeP    float64
+	threshold int
+	cooldown  time.Duration
+	mux       sync.Mutex
+	failures  int
+	openUntil time.Time
+	probing   bool
+	latencies map[string]*latencyTracker
+}
+
+func NewS3Retrier(c *cli.Context) *S3Retrier {
+	return &S3Retrier{
+		retries:   c.Int(s3RetriesFlag),
+		baseDelay: c.Duration(s3RetryBaseDelayFlag),
+		maxDelay:  c.Duration(s3RetryMaxDelayFlag),
+		hedgeP:    c.Float64(s3HedgePercentileFlag),
+		threshold: c.Int(s3BreakerThresholdFlag),
+		cooldown:  c.Duration(s3BreakerCooldownFlag),
+		latencies: map[string]*latencyTracker{},
+	}
+}
+
+// classifyS3Error returns error class used in logs and metrics
+func classifyS3Error(err error) string {
+	if err == nil {
+		return "ok"
+	}
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return "canceled"
+	}
+	if request.IsErrorThrottle(err) {
+		return "throttled"
+	}
+	if rf, ok := err.(awserr.RequestFailure); ok && rf.StatusCode() >= 500 {
+		return "server"
+	}
+	if aerr, ok := err.(awserr.Error); ok {
+		switch aerr.Code() {
+		case request.CanceledErrorCode:
+			return "canceled"
+		case request.ErrCodeResponseTimeout, "RequestTimeout", "RequestTimeoutException":
+			return "timeout"
+		}
+	}
+	if request.IsErrorRetryable(err) {
+		return "network"
+	}
+	return "client"
+}
+
+func isRetryableS3Error(class string) bool {
+	switch class {
+	case "throttled", "server", "timeout", "network":
+		return true
+	}
+	return false
+}
+
+func (s *S3Retrier) allow() bool {
+	if s.threshold == 0 {
+		return true
+	}
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	if s.failures < s.threshold {
+		return true
+	}
+	if time.Now().Before(s.openUntil) || s.probing {
+		return false
+	}
+	// half-open: let single probe through
+	s.probing = true
+	return true
+}
+
+func (s *S3Retrier) record(err error) {
+	if s.threshold == 0 {
+		return
+	}
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	s.probing = false
+	if err == nil {
+		if s.failures >= s.threshold {
+			log.Info("S3 circuit breaker closed")
+		}
+		s.failures = 0
+		return
+	}
+	s.failures++
+	if s.failures >= s.threshold {
+		if s.failures == s.threshold {
+			log.Warnf("S3 circuit breaker opened failures=%v", s.failures)
+		}
+		s3Metrics.Add("breaker.open", 1)
+		s.openUntil = time.Now().Add(s.cooldown)
+	}
+}
+
+// release frees half-open probe slot without changing breaker state
+func (s *S3Retrier) release() {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	s.probing = false
+}
+
+func (s *S3Retrier) backoff(attempt int) time.Duration {
+	d := float64(s.baseDelay) * math.Pow(2, float64(attempt))
+	if d > float64(s.maxDelay) {
+		d = float64(s.maxDelay)
+	}
+	// full jitter
+	return time.Duration(rand.Float64() * d)
+}
+
+func (s *S3Retrier) tracker(op string) *latencyTracker {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	t, ok := s.latencies[op]
+	if !ok {
+		t = &latencyTracker{}
+		s.latencies[op] = t
+	}
+	return t
+}
+
+// Do runs f with retries, if hedge is set slow attempts are raced
+// with second one. Results of lost attempts are closed if possible.
+func (s *S3Retrier) Do(ctx context.Context, op string, hedge bool, f func(ctx context.Context) (interface{}, error)) (interface{}, error) {
+	if !s.allow() {
+		s3Metrics.Add(op+".fail.breaker", 1)
+		return nil, ErrCircuitOpen
+	}
+	var err error
+	for i := 0; i <= s.retries; i++ {
+		if i > 0 {
+			d := s.backoff(i - 1)
+			select {
+			case <-time.After(d):
+			case <-ctx.Done():
+				s.release()
+				return nil, ctx.Err()
+			}
+		}
+		var v interface{}
+		if hedge && s.hedgeP > 0 {
+			v, err = s.hedged(ctx, op, f)
+		} else {
+			v, err = s.attempt(ctx, op, f)
+		}
+		class := classifyS3Error(err)
+		if err == nil {
+			s3Metrics.Add(op+".success", 1)
+			s.record(nil)
+			return v, nil
+		}
+		if !isRetryableS3Error(class) {
+			s3Metrics.Add(op+".fail."+class, 1)
+			s.release()
+			return nil, err
+		}
+		s3Metrics.Add(op+".retry."+class, 1)
+		log.WithError(err).Warnf("S3 attempt failed op=%v attempt=%v class=%v", op, i+1, class)
+	}
+	class := classifyS3Error(err)
+	s3Metrics.Add(op+".fail."+class, 1)
+	s.record(err)
+	return nil, errors.Wrapf(err, "S3 attempts exhausted op=%v class=%v", op, class)
+}
+
+func (s *S3Retrier) attempt(ctx context.Context, op string, f func(ctx context.Context) (interface{}, error)) (interface{}, error) {
+	start := time.Now()
+	v, err := f(ctx)
+	if err == nil {
+		s.tracker(op).add(time.Since(start))
+	}
+	return v, err
+}
+
+type attemptResult struct {
+	v   interface{}
+	err error
+	i   int
+}
+
+func (s *S3Retrier) hedged(ctx context.Context, op string, f func(ctx context.Context) (interface{}, error)) (interface{}, error) {
+	delay, ok := s.tracker(op).percentile(s.hedgeP)
+	if !ok {
+		return s.attempt(ctx, op, f)
+	}
+	ch := make(chan attemptResult, 2)
+	// attempt contexts outlive hedged, as winner's body is read later,
+	// so they are canceled when the attempt is released
+	cancels := []context.CancelFunc{}
+	run := func(i int) {
+		actx, cancel := context.WithCancel(ctx)
+		cancels = append(cancels, cancel)
+		go func() {
+			v, err := s.attempt(actx, op, f)
+			ch <- attemptResult{v: v, err: err, i: i}
+		}()
+	}
+	run(0)
+	var res attemptResult
+	select {
+	case res = <-ch:
+		return withCancel(res.v, cancels[0]), res.err
+	case <-time.After(delay):
+	}
+	s3Metrics.Add(op+".hedged", 1)
+	run(1)
+	res = <-ch
+	if res.err != nil {
+		// let the other attempt finish
+		other := <-ch
+		if other.err == nil {
+			res, other = other, res
+		}
+		if other.err == nil {
+			closeResult(other.v)
+		}
+		cancels[other.i]()
+	} else {
+		cancels[1-res.i]()
+		go func() {
+			other := <-ch
+			if other.err == nil {
+				closeResult(other.v)
+			}
+		}()
+	}
+	if res.err != nil {
+		cancels[res.i]()
+	}
+	if res.i == 1 && res.err == nil {
+		s3Metrics.Add(op+".hedge_won", 1)
+	}
+	return withCancel(res.v, cancels[res.i]), res.err
+}
+
+// withCancel releases attempt context once result is consumed
+func withCancel(v interface{}, cancel context.CancelFunc) interface{} {
+	r, ok := v.(*s3.GetObjectOutput)
+	if !ok || r == nil || r.Body == nil {
+		cancel()
+		return v
+	}
+	r.Body = &cancelReadCloser{ReadCloser: r.Body, cancel: cancel}
+	return r
+}
+
+type cancelReadCloser struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (s *cancelReadCloser) Close() error {
+	defer s.cancel()
+	return s.ReadCloser.Close()
+}
+
+func closeResult(v interface{}) {
+	switch r := v.(type) {
+	case *s3.GetObjectOutput:
+		if r != nil && r.Body != nil {
+			r.Body.Close()
+		}
+	case io.Closer:
+		r.Close()
+	}
+}
+
+// latencyTracker keeps recent successful latencies of S3 operation
+type latencyTracker struct {
+	mux     sync.Mutex
+	samples []time.Duration
+	pos     int
+}
+
+func (s *latencyTracker) add(d time.Duration) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	if len(s.samples) < latencySamples {
+		s.samples = append(s.samples, d)
+		return
+	}
+	s.samples[s.pos] = d
+	s.pos = (s.pos + 1) % latencySamples
+}
+
+func (s *latencyTracker) percentile(p float64) (time.Duration, bool) {
+	s.mux.Lock()
+	if len(s.samples) < minLatencySamples {
+		s.mux.Unlock()
+		return 0, false
+	}
+	ss := make([]time.Duration, len(s.samples))
+	copy(ss, s.samples)
+	s.mux.Unlock()
+	sort.Slice(ss, func(i, j int) bool {
+		return ss[i] < ss[j]
+	})
+	i := int(math.Ceil(p/100*float64(len(ss)))) - 1
+	if i < 0 {
+		i = 0
+	}
+	if i >= len(ss) {
+		i = len(ss) - 1
+	}
+	return ss[i], true
+}
@@ -5,6 +5,7 @@ import (
 	"context"
 	"fmt"
 	"io"
+	"strings"
 	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
@@ -21,10 +22,12 @@ import (
 type S3Storage struct {
 	bucket string
 	cl     *cs.S3Client
+	r      *S3Retrier
 }
 
 const (
 	awsBucketFlag = "aws-bucket"
+	maxListPages  = 10
 )
 
 func RegisterS3StorageFlags(c *cli.App) {
@@ -36,53 +39,167 @@ func RegisterS3StorageFlags(c *cli.App) {
 	})
 }
 
-func NewS3Storage(c *cli.Context, cl *cs.S3Client) *S3Storage {
+func NewS3Storage(c *cli.Context, cl *cs.S3Client, r *S3Retrier) *S3Storage {
 	return &S3Storage{
 		bucket: c.String(awsBucketFlag),
 		cl:     cl,
+		r:      r,
 	}
 }
 
-func (s *S3Storage) GetContent(ctx context.Context, key string, path string) (io.ReadCloser, error) {
+func (s *S3Storage) GetContent(ctx context.Context, key string, path string) (io.ReadCloser, *ContentInfo, error) {
 	key = key + path
 	log.Infof("fetching content key=%v bucket=%v", key, s.bucket)
-	r, err := s.cl.Get().GetObjectWithContext(ctx, &s3.GetObjectInput{
-		Bucket: aws.String(s.bucket),
-		Key:    aws.String(key),
+	v, err := s.r.Do(ctx, "get", true, func(ctx context.Context) (interface{}, error) {
+		return s.cl.Get().GetObjectWithContext(ctx, &s3.GetObjectInput{
+			Bucket: aws.String(s.bucket),
+			Key:    aws.String(key),
+		}, noSDKRetries)
 	})
 	if err != nil {
-		if awsErr, ok := err.(awserr.Error); ok && awsErr.Code() == s3.ErrCodeNoSuchKey {
+		if isNotFound(errors.Cause(err)) {
+			log.Infof("content not found key=%v bucket=%v", key, s.bucket)
+			return nil, nil, nil
+		}
+		return nil, nil, errors.Wrap(err, "failed to fetch content")
+	}
+	r := v.(*s3.GetObjectOutput)
+	return r.Body, &ContentInfo{
+		Size:        aws.Int64Value(r.ContentLength),
+		ContentType: aws.StringValue(r.ContentType),
+		ETag:        aws.StringValue(r.ETag),
+	}, nil
+}
+
+type ContentInfo struct {
+	Size        int64
+	ContentType string
+	ETag        string
+}
+
+func isNotFound(err error) bool {
+	if awsErr, ok := err.(awserr.Error); ok {
+		return awsErr.Code() == s3.ErrCodeNoSuchKey || awsErr.Code() == "NotFound"
+	}
+	return false
+}
+
+func (s *S3Storage) HeadContent(ctx context.Context, key string, path string) (*ContentInfo, error) {
+	key = key + path
+	log.Infof("fetching content info key=%v bucket=%v", key, s.bucket)
+	v, err := s.r.Do(ctx, "head", true, func(ctx context.Context) (interface{}, error) {
+		return s.cl.Get().HeadObjectWithContext(ctx, &s3.HeadObjectInput{
+			Bucket: aws.String(s.bucket),
+			Key:    aws.String(key),
+		}, noSDKRetries)
+	})
+	if err != nil {
+		if isNotFound(errors.Cause(err)) {
+			log.Infof("content not found key=%v bucket=%v", key, s.bucket)
+			return nil, nil
+		}
+		return nil, errors.Wrap(err, "failed to fetch content info")
+	}
+	r := v.(*s3.HeadObjectOutput)
+	return &ContentInfo{
+		Size:        aws.Int64Value(r.ContentLength),
+		ContentType: aws.StringValue(r.ContentType),
+		ETag:        aws.StringValue(r.ETag),
+	}, nil
+}
+
+func (s *S3Storage) GetContentRange(ctx context.Context, key string, path string, start int64, end int64) (io.ReadCloser, error) {
+	key = key + path
+	log.Infof("fetching content range key=%v bucket=%v start=%v end=%v", key, s.bucket, start, end)
+	v, err := s.r.Do(ctx, "get_range", true, func(ctx context.Context) (interface{}, error) {
+		return s.cl.Get().GetObjectWithContext(ctx, &s3.GetObjectInput{
+			Bucket: aws.String(s.bucket),
+			Key:    aws.String(key),
+			Range:  aws.String(fmt.Sprintf("bytes=%v-%v", start, end)),
+		}, noSDKRetries)
+	})
+	if err != nil {
+		if isNotFound(errors.Cause(err)) {
 			log.Infof("content not found key=%v bucket=%v", key, s.bucket)
 			return nil, nil
 		}
-		return nil, errors.Wrap(err, "failed to fetch content")
+		return nil, errors.Wrap(err, "failed to fetch content range")
+	}
+	return v.(*s3.GetObjectOutput).Body, nil
+}
+
+// ListContent returns names of objects in directory dir of key
+func (s *S3Storage) ListContent(ctx context.Context, key string, dir string) ([]string, error) {
+	prefix := strings.TrimSuffix(key+dir, "/") + "/"
+	log.Infof("listing content prefix=%v bucket=%v", prefix, s.bucket)
+	res := []string{}
+	var token *string
+	for i := 0; i < maxListPages; i++ {
+		v, err := s.r.Do(ctx, "list", false, func(ctx context.Context) (interface{}, error) {
+			return s.cl.Get().ListObjectsV2WithContext(ctx, &s3.ListObjectsV2Input{
+				Bucket:            aws.String(s.bucket),
+				Prefix:            aws.String(prefix),
+				Delimiter:         aws.String("/"),
+				ContinuationToken: token,
+			}, noSDKRetries)
+		})
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to list content prefix=%v bucket=%v", prefix, s.bucket)
+		}
+		r := v.(*s3.ListObjectsV2Output)
+		for _, o := range r.Contents {
+			res = append(res, strings.TrimPrefix(aws.StringValue(o.Key), prefix))
+		}
+		if !aws.BoolValue(r.IsTruncated) {
+			break
+		}
+		token = r.NextContinuationToken
 	}
-	return r.Body, nil
+	return res, nil
 }
 
-func (s *S3Storage) CheckDoneMarker(ctx context.Context, key string) (bool, *time.Time, error) {
+func (s *S3Storage) CheckDoneMarker(ctx context.Context, key string) (*DoneMarker, error) {
 	key = "done/" + key
 	log.Infof("check done marker bucket=%v key=%v", s.bucket, key)
-	r, err := s.cl.Get().GetObjectWithContext(ctx, &s3.GetObjectInput{
-		Bucket: aws.String(s.bucket),
-		Key:    aws.String(key),
+	v, err := s.r.Do(ctx, "done", true, func(ctx context.Context) (interface{}, error) {
+		return s.cl.Get().GetObjectWithContext(ctx, &s3.GetObjectInput{
+			Bucket: aws.String(s.bucket),
+			Key:    aws.String(key),
+		}, noSDKRetries)
 	})
 	if err != nil {
-		if awsErr, ok := err.(awserr.Error); ok && awsErr.Code() == s3.ErrCodeNoSuchKey {
-			return false, nil, nil
+		if isNotFound(errors.Cause(err)) {
+			return nil, nil
+		}
+		return nil, errors.Wrapf(err, "failed to check done marker bucket=%v key=%v", s.bucket, key)
+	}
+	r := v.(*s3.GetObjectOutput)
+	defer r.Body.Close()
+	m := &DoneMarker{
+		Time: r.LastModified,
+	}
+	size := aws.Int64Value(r.ContentLength)
+	if size > 0 && size <= maxDoneMarkerBodySize {
+		b, err := io.ReadAll(io.LimitReader(r.Body, maxDoneMarkerBodySize))
+		if err != nil {
+			log.WithError(err).Warnf("failed to read done marker body bucket=%v key=%v", s.bucket, key)
+		} else {
+			m.applyBody(key, b)
 		}
-		return false, nil, errors.Wrapf(err, "failed to check done marker bucket=%v key=%v", s.bucket, key)
 	}
-	return true, r.LastModified, nil
+	m.applyMetadata(r.Metadata)
+	return m, nil
 }
 
 func (s *S3Storage) Touch(ctx context.Context, key string) (err error) {
 	key = "touch/" + key
 	log.Infof("touching bucket=%v key=%v", s.bucket, key)
-	_, err = s.cl.Get().PutObjectWithContext(ctx, &s3.PutObjectInput{
-		Bucket: aws.String(s.bucket),
-		Key:    aws.String(key),
-		Body:   bytes.NewReader([]byte(fmt.Sprintf("%v", time.Now().Unix()))),
+	_, err = s.r.Do(ctx, "touch", false, func(ctx context.Context) (interface{}, error) {
+		return s.cl.Get().PutObjectWithContext(ctx, &s3.PutObjectInput{
+			Bucket: aws.String(s.bucket),
+			Key:    aws.String(key),
+			Body:   bytes.NewReader([]byte(fmt.Sprintf("%v", time.Now().Unix()))),
+		}, noSDKRetries)
 	})
 	if err != nil {
 		return errors.Wrapf(err, "failed to touch bucket=%v key=%v", s.bucket, key)
@@ -0,0 +1,64 @@
+package services
+
+import (
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/urfave/cli"
+)
+
+const (
+	segmentBaseURLFlag = "segment-base-url"
+	segmentShardsFlag  = "segment-shards"
+)
+
+func RegisterSegmentURLFlags(c *cli.App) {
+	c.Flags = append(c.Flags, cli.StringFlag{
+		Name: segmentBaseURLFlag,
+		Usage: "base URL template of segment URIs in playlists, e.g. https://cdn{shard}.example.com, " +
+			"playlist directory and segment name are appended to it (empty keeps URIs relative)",
+		Value:  "",
+		EnvVar: "SEGMENT_BASE_URL",
+	})
+	c.Flags = append(c.Flags, cli.IntFlag{
+		Name:   segmentShardsFlag,
+		Usage:  "number of shards substituted as {shard} by segment number",
+		Value:  1,
+		EnvVar: "SEGMENT_SHARDS",
+	})
+}
+
+// SegmentURL makes segment URIs of rewritten playlists
+type SegmentURL struct {
+	tpl    string
+	shards int
+}
+
+func NewSegmentURL(c *cli.Context) *SegmentURL {
+	shards := c.Int(segmentShardsFlag)
+	if shards < 1 {
+		shards = 1
+	}
+	return &SegmentURL{
+		tpl:    c.String(segmentBaseURLFlag),
+		shards: shards,
+	}
+}
+
+// Make returns URI of segment referenced from playlist at playlistPath
+func (s *SegmentURL) Make(playlistPath string, name string, query string) string {
+	u := name
+	if s.tpl != "" && !strings.HasSuffix(name, ".m3u8") {
+		shard := 0
+		if f := NewFragment(name); f != nil {
+			shard = f.num % s.shards
+		}
+		base := strings.TrimSuffix(strings.ReplaceAll(s.tpl, "{shard}", strconv.Itoa(shard)), "/")
+		u = base + path.Join(path.Dir(playlistPath), name)
+	}
+	if query != "" {
+		u += "?" + query
+	}
+	return u
+}
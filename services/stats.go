@@ -0,0 +1,165 @@
+package services
+
+import (
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	statsBucketSize = time.Minute
+	statsBuckets    = 24 * 60
+	statsByRequests = "requests"
+	statsByBytes    = "bytes"
+)
+
+type StatsEntry struct {
+	Key       string `json:"key"`
+	Rendition string `json:"rendition,omitempty"`
+	Requests  int64  `json:"requests"`
+	Bytes     int64  `json:"bytes"`
+	path      string
+	last      int64
+}
+
+type statsKey struct {
+	key       string
+	rendition string
+}
+
+type statsCounter struct {
+	requests int64
+	bytes    int64
+	path     string
+}
+
+type statsBucket struct {
+	t    int64
+	m    map[statsKey]*statsCounter
+	keys map[string]*statsCounter
+}
+
+// Stats counts requests and bytes served per cache key and rendition
+// in minute buckets, so they can be summed over sliding windows
+type Stats struct {
+	mux     sync.Mutex
+	buckets [statsBuckets]*statsBucket
+}
+
+func NewStats() *Stats {
+	return &Stats{}
+}
+
+// renditionOf returns rendition name of the path, e.g. v0 for /v0-12.ts
+func renditionOf(path string) string {
+	base := filepath.Base(path)
+	if f := NewFragment(base); f != nil {
+		return strings.TrimSuffix(f.prefix, "-")
+	}
+	return strings.TrimSuffix(base, filepath.Ext(base))
+}
+
+func (s *Stats) bucket(now time.Time) *statsBucket {
+	t := now.UnixNano() / int64(statsBucketSize)
+	i := t % statsBuckets
+	b := s.buckets[i]
+	if b == nil || b.t != t {
+		b = &statsBucket{
+			t:    t,
+			m:    map[statsKey]*statsCounter{},
+			keys: map[string]*statsCounter{},
+		}
+		s.buckets[i] = b
+	}
+	return b
+}
+
+func (s *Stats) Add(key string, path string, bytes int64) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	b := s.bucket(time.Now())
+	sk := statsKey{key: key, rendition: renditionOf(path)}
+	c, ok := b.m[sk]
+	if !ok {
+		c = &statsCounter{}
+		b.m[sk] = c
+	}
+	c.requests++
+	c.bytes += bytes
+	c.path = path
+	kc, ok := b.keys[key]
+	if !ok {
+		kc = &statsCounter{}
+		b.keys[key] = kc
+	}
+	kc.requests++
+	kc.bytes += bytes
+}
+
+// window calls f for each bucket inside the window
+func (s *Stats) window(w time.Duration, f func(b *statsBucket)) {
+	if w > statsBuckets*statsBucketSize {
+		w = statsBuckets * statsBucketSize
+	}
+	now := time.Now().UnixNano() / int64(statsBucketSize)
+	from := now - int64((w+statsBucketSize-1)/statsBucketSize)
+	for _, b := range s.buckets {
+		if b != nil && b.t > from && b.t <= now {
+			f(b)
+		}
+	}
+}
+
+// Requests returns number of requests of the key inside the window
+func (s *Stats) Requests(key string, w time.Duration) int64 {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	var res int64
+	s.window(w, func(b *statsBucket) {
+		if c, ok := b.keys[key]; ok {
+			res += c.requests
+		}
+	})
+	return res
+}
+
+// Top returns n most popular keys (or key renditions) inside the window
+func (s *Stats) Top(n int, w time.Duration, by string, rendition bool) []StatsEntry {
+	s.mux.Lock()
+	m := map[statsKey]*StatsEntry{}
+	s.window(w, func(b *statsBucket) {
+		for k, c := range b.m {
+			if !rendition {
+				k.rendition = ""
+			}
+			e, ok := m[k]
+			if !ok {
+				e = &StatsEntry{Key: k.key, Rendition: k.rendition}
+				m[k] = e
+			}
+			e.Requests += c.requests
+			e.Bytes += c.bytes
+			if b.t >= e.last {
+				e.last = b.t
+				e.path = c.path
+			}
+		}
+	})
+	s.mux.Unlock()
+	res := make([]StatsEntry, 0, len(m))
+	for _, e := range m {
+		res = append(res, *e)
+	}
+	sort.Slice(res, func(i, j int) bool {
+		if by == statsByBytes {
+			return res[i].Bytes > res[j].Bytes
+		}
+		return res[i].Requests > res[j].Requests
+	})
+	if n > 0 && len(res) > n {
+		res = res[:n]
+	}
+	return res
+}
@@ -0,0 +1,288 @@
+package services
+
+import (
+	"context"
+	"crypto/sha1"
+	"fmt"
+	"io"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/urfave/cli"
+	"github.com/webtor-io/lazymap"
+)
+
+const (
+	subtitlesFlag          = "subtitles"
+	subtitlesCachePath     = "cache/subtitles"
+	subtitlePlaylistSuffix = ".vtt.m3u8"
+)
+
+var subtitleSourceExts = []string{".srt", ".ass", ".ssa"}
+
+// subtitleAttributeReplacer removes characters not allowed in quoted playlist attributes
+var subtitleAttributeReplacer = strings.NewReplacer(`"`, "", "\n", "", "\r", "")
+
+// subtitleURIReplacer escapes the same characters in URI attribute keeping it resolvable
+var subtitleURIReplacer = strings.NewReplacer(`"`, "%22", "\n", "%0A", "\r", "%0D")
+
+func RegisterSubtitleConverterFlags(c *cli.App) {
+	c.Flags = append(c.Flags, cli.BoolFlag{
+		Name:   subtitlesFlag,
+		Usage:  "convert sidecar SRT/SSA/ASS subtitles to WebVTT and inject them into master playlists",
+		EnvVar: "SUBTITLES",
+	})
+}
+
+// SubtitleTrack is sidecar subtitle available in playlist directory
+type SubtitleTrack struct {
+	Name     string
+	Language string
+}
+
+// SubtitleConverter serves WebVTT subtitles and subtitle media playlists
+// converted from sidecar subtitles found in storage
+type SubtitleConverter struct {
+	enabled bool
+	c       ContentCache
+	s3st    *S3Storage
+	dp      *DonePool
+	tr      *Tracer
+	files   *GeneratedCache
+	lists   lazymap.LazyMap
+}
+
+func NewSubtitleConverter(c *cli.Context, ca ContentCache, s3st *S3Storage, dp *DonePool, tr *Tracer) *SubtitleConverter {
+	return &SubtitleConverter{
+		enabled: c.Bool(subtitlesFlag),
+		c:       ca,
+		s3st:    s3st,
+		dp:      dp,
+		tr:      tr,
+		files:   NewGeneratedCache(subtitlesCachePath),
+		lists: lazymap.New(&lazymap.Config{
+			Concurrency: 10,
+			Expire:      600 * time.Second,
+			ErrorExpire: 30 * time.Second,
+			Capacity:    1000,
+		}),
+	}
+}
+
+func (s *SubtitleConverter) Enabled() bool {
+	return s.enabled
+}
+
+// Supports reports whether path may be produced by conversion
+func (s *SubtitleConverter) Supports(p string) bool {
+	return s.enabled && (strings.HasSuffix(p, ".vtt") || strings.HasSuffix(p, subtitlePlaylistSuffix))
+}
+
+func (s *SubtitleConverter) makeKey(key string, p string) (string, error) {
+	_, t, err := s.dp.Done(key)
+	if err != nil {
+		return "", errors.Wrapf(err, "failed to get key")
+	}
+	if t == nil {
+		return "", &NotFoundError{errors.Errorf("content is not done key=%v", key)}
+	}
+	return fmt.Sprintf("%x", sha1.Sum([]byte(key+p+t.String()))), nil
+}
+
+// Get returns converted subtitles or generated subtitle playlist, nil if there is no source
+func (s *SubtitleConverter) Get(ctx context.Context, key string, p string) (io.ReadSeekCloser, error) {
+	kk, err := s.makeKey(key, p)
+	if err != nil {
+		return nil, err
+	}
+	f, err := s.files.Get(kk, func() ([]byte, bool, error) {
+		ctx, sp := s.tr.Start(context.WithoutCancel(ctx), "subtitles.convert")
+		defer sp.End()
+		ctx, cancel := context.WithTimeout(ctx, 60*time.Second)
+		defer cancel()
+		var res string
+		var ok bool
+		var err error
+		if strings.HasSuffix(p, ".vtt") {
+			res, ok, err = s.convert(ctx, key, p)
+		} else {
+			res, ok, err = s.playlist(ctx, key, p)
+		}
+		setSpanError(sp, err)
+		return []byte(res), ok, err
+	})
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to convert subtitles key=%v path=%v", key, p)
+	}
+	return f, nil
+}
+
+func (s *SubtitleConverter) read(ctx context.Context, key string, p string) ([]byte, bool, error) {
+	c, _, err := s.c.Get(ctx, key, p)
+	if err != nil {
+		return nil, false, err
+	}
+	if c == nil {
+		return nil, false, nil
+	}
+	defer c.Close()
+	b, err := io.ReadAll(c)
+	if err != nil {
+		return nil, false, errors.Wrapf(err, "failed to read subtitles path=%v", p)
+	}
+	return b, true, nil
+}
+
+// convert converts first found sidecar subtitles with the same name to WebVTT
+func (s *SubtitleConverter) convert(ctx context.Context, key string, p string) (string, bool, error) {
+	base := strings.TrimSuffix(p, ".vtt")
+	for _, ext := range subtitleSourceExts {
+		b, ok, err := s.read(ctx, key, base+ext)
+		if err != nil {
+			return "", false, err
+		}
+		if !ok {
+			continue
+		}
+		src := decodeSubtitles(b)
+		if ext == ".srt" {
+			return srtToVTT(src), true, nil
+		}
+		return assToVTT(src), true, nil
+	}
+	return "", false, nil
+}
+
+// playlist generates single segment media playlist of subtitles
+func (s *SubtitleConverter) playlist(ctx context.Context, key string, p string) (string, bool, error) {
+	vp := strings.TrimSuffix(p, subtitlePlaylistSuffix) + ".vtt"
+	b, ok, err := s.read(ctx, key, vp)
+	if err != nil {
+		return "", false, err
+	}
+	vtt := string(b)
+	if !ok {
+		vtt, ok, err = s.convert(ctx, key, vp)
+		if err != nil || !ok {
+			return "", false, err
+		}
+	}
+	return makeSubtitlePlaylist(path.Base(vp), vttDuration(vtt)), true, nil
+}
+
+// Tracks returns sidecar subtitles of directory dir
+func (s *SubtitleConverter) Tracks(ctx context.Context, key string, dir string) ([]SubtitleTrack, error) {
+	kk, err := s.makeKey(key, dir)
+	if err != nil {
+		return nil, err
+	}
+	v, err := s.lists.Get(kk, func() (interface{}, error) {
+		ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), 30*time.Second)
+		defer cancel()
+		names, err := s.s3st.ListContent(ctx, key, dir)
+		if err != nil {
+			return nil, err
+		}
+		return subtitleTracks(names), nil
+	})
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to list subtitles key=%v dir=%v", key, dir)
+	}
+	return v.([]SubtitleTrack), nil
+}
+
+func subtitleTracks(names []string) []SubtitleTrack {
+	seen := map[string]bool{}
+	res := []SubtitleTrack{}
+	for _, n := range names {
+		ext := strings.ToLower(path.Ext(n))
+		src := ext == ".vtt" && NewFragment(n) == nil
+		for _, e := range subtitleSourceExts {
+			if ext == e {
+				src = true
+			}
+		}
+		base := strings.TrimSuffix(n, path.Ext(n))
+		if !src || seen[base] {
+			continue
+		}
+		seen[base] = true
+		res = append(res, SubtitleTrack{
+			Name:     base,
+			Language: subtitleLanguage(base),
+		})
+	}
+	sort.Slice(res, func(i, j int) bool {
+		return res[i].Name < res[j].Name
+	})
+	return res
+}
+
+// subtitleLanguage guesses language from names like movie.en or pt-BR
+func subtitleLanguage(base string) string {
+	l := base
+	if i := strings.LastIndex(base, "."); i >= 0 {
+		l = base[i+1:]
+	}
+	parts := strings.SplitN(l, "-", 2)
+	if len(parts[0]) < 2 || len(parts[0]) > 3 {
+		return ""
+	}
+	for _, r := range parts[0] {
+		if (r < 'a' || r > 'z') && (r < 'A' || r > 'Z') {
+			return ""
+		}
+	}
+	return l
+}
+
+// injectSubtitles adds EXT-X-MEDIA entries of subtitle tracks missing in master playlist
+func injectSubtitles(lines []string, tracks []SubtitleTrack) []string {
+	group := ""
+	existing := strings.Join(lines, "\n")
+	for _, l := range lines {
+		if strings.HasPrefix(l, "#EXT-X-STREAM-INF") {
+			if g := parseAttributes(l)["SUBTITLES"]; g != "" {
+				group = g
+				break
+			}
+		}
+	}
+	media := []string{}
+	for _, t := range tracks {
+		name := t.Name + subtitlePlaylistSuffix
+		if strings.Contains(existing, name) || strings.Contains(existing, t.Name+".vtt") {
+			continue
+		}
+		if group == "" {
+			group = "subs"
+		}
+		attrs := fmt.Sprintf(`#EXT-X-MEDIA:TYPE=SUBTITLES,GROUP-ID="%v",NAME="%v"`, group, subtitleAttributeReplacer.Replace(t.Name))
+		if l := subtitleAttributeReplacer.Replace(t.Language); l != "" {
+			attrs += fmt.Sprintf(`,LANGUAGE="%v"`, l)
+		}
+		attrs += fmt.Sprintf(`,AUTOSELECT=YES,DEFAULT=NO,URI="%v"`, subtitleURIReplacer.Replace(name))
+		media = append(media, attrs)
+	}
+	if len(media) == 0 {
+		return lines
+	}
+	res := make([]string, 0, len(lines)+len(media))
+	injected := false
+	for _, l := range lines {
+		if strings.HasPrefix(l, "#EXT-X-STREAM-INF") {
+			if !injected {
+				res = append(res, media...)
+				injected = true
+			}
+			if parseAttributes(l)["SUBTITLES"] == "" {
+				l += fmt.Sprintf(`,SUBTITLES="%v"`, group)
+			}
+		}
+		res = append(res, l)
+	}
+	return res
+}
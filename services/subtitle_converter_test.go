@@ -0,0 +1,50 @@
+package services
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestSubtitleConverterSupports(t *testing.T) {
+	s := &SubtitleConverter{enabled: true}
+	tests := []struct {
+		path string
+		want bool
+	}{
+		{"/k/en.vtt", true},
+		{"/k/en.vtt.m3u8", true},
+		{"/k/index.m3u8", false},
+		{"/k/v0-iframes.m3u8", false},
+		{"/k/v0-1.ts", false},
+	}
+	for _, tt := range tests {
+		if got := s.Supports(tt.path); got != tt.want {
+			t.Errorf("Supports(%q) = %v, want %v", tt.path, got, tt.want)
+		}
+	}
+	if (&SubtitleConverter{}).Supports("/k/en.vtt") {
+		t.Errorf("disabled converter supports subtitles")
+	}
+}
+
+func TestInjectSubtitles(t *testing.T) {
+	lines := []string{
+		"#EXTM3U",
+		`#EXT-X-STREAM-INF:BANDWIDTH=800000`,
+		"v0.m3u8",
+	}
+	tracks := []SubtitleTrack{
+		{Name: "movie.en", Language: "en"},
+		{Name: "movie\"\r\n,URI=\"x", Language: "e\"n\n"},
+	}
+	want := []string{
+		"#EXTM3U",
+		`#EXT-X-MEDIA:TYPE=SUBTITLES,GROUP-ID="subs",NAME="movie.en",LANGUAGE="en",AUTOSELECT=YES,DEFAULT=NO,URI="movie.en.vtt.m3u8"`,
+		`#EXT-X-MEDIA:TYPE=SUBTITLES,GROUP-ID="subs",NAME="movie,URI=x",LANGUAGE="en",AUTOSELECT=YES,DEFAULT=NO,URI="movie%22%0D%0A,URI=%22x.vtt.m3u8"`,
+		`#EXT-X-STREAM-INF:BANDWIDTH=800000,SUBTITLES="subs"`,
+		"v0.m3u8",
+	}
+	if got := injectSubtitles(lines, tracks); !reflect.DeepEqual(got, want) {
+		t.Errorf("injectSubtitles() = %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,258 @@
+package services
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"math"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode/utf16"
+	"unicode/utf8"
+)
+
+var windows1251High = [64]rune{
+	0x0402, 0x0403, 0x201A, 0x0453, 0x201E, 0x2026, 0x2020, 0x2021, 0x20AC, 0x2030, 0x0409, 0x2039, 0x040A, 0x040C, 0x040B, 0x040F,
+	0x0452, 0x2018, 0x2019, 0x201C, 0x201D, 0x2022, 0x2013, 0x2014, 0xFFFD, 0x2122, 0x0459, 0x203A, 0x045A, 0x045C, 0x045B, 0x045F,
+	0x00A0, 0x040E, 0x045E, 0x0408, 0x00A4, 0x0490, 0x00A6, 0x00A7, 0x0401, 0x00A9, 0x0404, 0x00AB, 0x00AC, 0x00AD, 0x00AE, 0x0407,
+	0x00B0, 0x00B1, 0x0406, 0x0456, 0x0491, 0x00B5, 0x00B6, 0x00B7, 0x0451, 0x2116, 0x0454, 0x00BB, 0x0458, 0x0405, 0x0455, 0x0457,
+}
+
+var windows1252High = [32]rune{
+	0x20AC, 0xFFFD, 0x201A, 0x0192, 0x201E, 0x2026, 0x2020, 0x2021, 0x02C6, 0x2030, 0x0160, 0x2039, 0x0152, 0xFFFD, 0x017D, 0xFFFD,
+	0xFFFD, 0x2018, 0x2019, 0x201C, 0x201D, 0x2022, 0x2013, 0x2014, 0x02DC, 0x2122, 0x0161, 0x203A, 0x0153, 0xFFFD, 0x017E, 0x0178,
+}
+
+func decodeWindows1251(b []byte) string {
+	var sb strings.Builder
+	for _, c := range b {
+		switch {
+		case c < 0x80:
+			sb.WriteByte(c)
+		case c < 0xC0:
+			sb.WriteRune(windows1251High[c-0x80])
+		default:
+			sb.WriteRune(0x0410 + rune(c-0xC0))
+		}
+	}
+	return sb.String()
+}
+
+func decodeWindows1252(b []byte) string {
+	var sb strings.Builder
+	for _, c := range b {
+		switch {
+		case c < 0x80:
+			sb.WriteByte(c)
+		case c < 0xA0:
+			sb.WriteRune(windows1252High[c-0x80])
+		default:
+			sb.WriteRune(rune(c))
+		}
+	}
+	return sb.String()
+}
+
+func decodeUTF16(b []byte, bigEndian bool) string {
+	u := make([]uint16, 0, len(b)/2)
+	for i := 0; i+1 < len(b); i += 2 {
+		if bigEndian {
+			u = append(u, uint16(b[i])<<8|uint16(b[i+1]))
+		} else {
+			u = append(u, uint16(b[i+1])<<8|uint16(b[i]))
+		}
+	}
+	return string(utf16.Decode(u))
+}
+
+// decodeSubtitles detects charset of subtitle file and returns it as UTF-8.
+// Files without BOM that are not valid UTF-8 are treated as Windows-1251
+// if letters from the upper half outnumber ASCII ones, as every Cyrillic letter
+// lives there, otherwise as Windows-1252 where accented letters are rare.
+func decodeSubtitles(b []byte) string {
+	switch {
+	case bytes.HasPrefix(b, []byte{0xEF, 0xBB, 0xBF}):
+		return string(b[3:])
+	case bytes.HasPrefix(b, []byte{0xFF, 0xFE}):
+		return decodeUTF16(b[2:], false)
+	case bytes.HasPrefix(b, []byte{0xFE, 0xFF}):
+		return decodeUTF16(b[2:], true)
+	case utf8.Valid(b):
+		return string(b)
+	}
+	ascii, high := 0, 0
+	for _, c := range b {
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z':
+			ascii++
+		case c >= 0xC0:
+			high++
+		}
+	}
+	if high > ascii {
+		return decodeWindows1251(b)
+	}
+	return decodeWindows1252(b)
+}
+
+var (
+	srtTimingRe = regexp.MustCompile(`^\s*(\d+):(\d{1,2}):(\d{1,2})[,.](\d{1,3})\s*-->\s*(\d+):(\d{1,2}):(\d{1,2})[,.](\d{1,3})`)
+	fontTagRe   = regexp.MustCompile(`(?i)</?font[^>]*>`)
+	assTagRe    = regexp.MustCompile(`\{[^}]*\}`)
+	vttTimingRe = regexp.MustCompile(`-->\s*(?:(\d+):)?(\d{1,2}):(\d{1,2})\.(\d{3})`)
+)
+
+func formatVTTTime(ms int64) string {
+	return fmt.Sprintf("%02d:%02d:%02d.%03d", ms/3600000, ms/60000%60, ms/1000%60, ms%1000)
+}
+
+func parseTime(h, m, sec, frac string) int64 {
+	hh, _ := strconv.ParseInt(h, 10, 64)
+	mm, _ := strconv.ParseInt(m, 10, 64)
+	ss, _ := strconv.ParseInt(sec, 10, 64)
+	// fraction is milliseconds in SRT and centiseconds in ASS
+	for len(frac) < 3 {
+		frac += "0"
+	}
+	ff, _ := strconv.ParseInt(frac, 10, 64)
+	return ((hh*60+mm)*60+ss)*1000 + ff
+}
+
+func normalizeNewlines(s string) string {
+	s = strings.ReplaceAll(s, "\r\n", "\n")
+	return strings.ReplaceAll(s, "\r", "\n")
+}
+
+// srtToVTT converts SubRip subtitles to WebVTT
+func srtToVTT(src string) string {
+	var sb strings.Builder
+	sb.WriteString("WEBVTT\n\n")
+	blocks := strings.Split(normalizeNewlines(src), "\n\n")
+	for _, b := range blocks {
+		lines := strings.Split(strings.Trim(b, "\n"), "\n")
+		for i, l := range lines {
+			m := srtTimingRe.FindStringSubmatch(l)
+			if m == nil {
+				continue
+			}
+			text := []string{}
+			for _, t := range lines[i+1:] {
+				if t = strings.TrimSpace(fontTagRe.ReplaceAllString(t, "")); t != "" {
+					text = append(text, strings.ReplaceAll(t, "-->", "->"))
+				}
+			}
+			if len(text) == 0 {
+				break
+			}
+			sb.WriteString(formatVTTTime(parseTime(m[1], m[2], m[3], m[4])))
+			sb.WriteString(" --> ")
+			sb.WriteString(formatVTTTime(parseTime(m[5], m[6], m[7], m[8])))
+			sb.WriteRune('\n')
+			sb.WriteString(strings.Join(text, "\n"))
+			sb.WriteString("\n\n")
+			break
+		}
+	}
+	return sb.String()
+}
+
+func parseASSTime(t string) (int64, bool) {
+	parts := strings.Split(strings.TrimSpace(t), ":")
+	if len(parts) != 3 {
+		return 0, false
+	}
+	sec := strings.SplitN(parts[2], ".", 2)
+	frac := "0"
+	if len(sec) == 2 {
+		frac = sec[1]
+	}
+	return parseTime(parts[0], parts[1], sec[0], frac), true
+}
+
+// assToVTT converts dialogue events of SSA/ASS subtitles to WebVTT, styling is dropped
+func assToVTT(src string) string {
+	var sb strings.Builder
+	sb.WriteString("WEBVTT\n\n")
+	format := []string{"Layer", "Start", "End", "Style", "Name", "MarginL", "MarginR", "MarginV", "Effect", "Text"}
+	events := false
+	scanner := bufio.NewScanner(strings.NewReader(normalizeNewlines(src)))
+	for scanner.Scan() {
+		l := strings.TrimSpace(scanner.Text())
+		if strings.HasPrefix(l, "[") {
+			events = strings.EqualFold(l, "[Events]")
+			continue
+		}
+		if !events {
+			continue
+		}
+		if strings.HasPrefix(l, "Format:") {
+			format = splitList(strings.TrimPrefix(l, "Format:"))
+			continue
+		}
+		if !strings.HasPrefix(l, "Dialogue:") {
+			continue
+		}
+		fields := strings.SplitN(strings.TrimPrefix(l, "Dialogue:"), ",", len(format))
+		if len(fields) != len(format) {
+			continue
+		}
+		var start, end int64
+		var text string
+		okStart, okEnd := false, false
+		for i, f := range format {
+			switch f {
+			case "Start":
+				start, okStart = parseASSTime(fields[i])
+			case "End":
+				end, okEnd = parseASSTime(fields[i])
+			case "Text":
+				text = fields[i]
+			}
+		}
+		if !okStart || !okEnd {
+			continue
+		}
+		text = assTagRe.ReplaceAllString(text, "")
+		text = strings.NewReplacer(`\N`, "\n", `\n`, "\n", `\h`, " ", "-->", "->").Replace(text)
+		text = strings.TrimSpace(text)
+		if text == "" {
+			continue
+		}
+		sb.WriteString(formatVTTTime(start))
+		sb.WriteString(" --> ")
+		sb.WriteString(formatVTTTime(end))
+		sb.WriteRune('\n')
+		sb.WriteString(text)
+		sb.WriteString("\n\n")
+	}
+	return sb.String()
+}
+
+// vttDuration returns end time of the last cue in seconds
+func vttDuration(vtt string) float64 {
+	var max int64
+	for _, m := range vttTimingRe.FindAllStringSubmatch(vtt, -1) {
+		h := m[1]
+		if h == "" {
+			h = "0"
+		}
+		if t := parseTime(h, m[2], m[3], m[4]); t > max {
+			max = t
+		}
+	}
+	return float64(max) / 1000
+}
+
+// makeSubtitlePlaylist returns single segment media playlist of WebVTT file
+func makeSubtitlePlaylist(name string, duration float64) string {
+	var sb strings.Builder
+	sb.WriteString("#EXTM3U\n")
+	sb.WriteString("#EXT-X-VERSION:3\n")
+	sb.WriteString(fmt.Sprintf("#EXT-X-TARGETDURATION:%v\n", int(math.Ceil(duration))))
+	sb.WriteString("#EXT-X-PLAYLIST-TYPE:VOD\n")
+	sb.WriteString(fmt.Sprintf("#EXTINF:%.3f,\n", duration))
+	sb.WriteString(name + "\n")
+	sb.WriteString("#EXT-X-ENDLIST\n")
+	return sb.String()
+}
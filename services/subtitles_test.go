@@ -0,0 +1,116 @@
+package services
+
+import (
+	"testing"
+)
+
+func TestDecodeSubtitles(t *testing.T) {
+	tests := []struct {
+		name string
+		in   string
+		want string
+	}{
+		{"utf-8", "Größe", "Größe"},
+		{"utf-8 bom", "\xef\xbb\xbfПривет", "Привет"},
+		{"utf-16le bom", "\xff\xfeH\x00i\x00\x1f\x04", "HiП"},
+		{"utf-16be bom", "\xfe\xff\x00H\x00i\x04\x1f", "HiП"},
+		{"windows-1252 adjacent accents", "Gr\xf6\xdfe", "Größe"},
+		{"windows-1252 german", "Die Gr\xf6\xdfe ist sch\xf6n. \xdcber den Flu\xdf.", "Die Größe ist schön. Über den Fluß."},
+		{"windows-1252 french", "\xc0 bient\xf4t, \xe7a va tr\xe8s bien\x85 \xabmerci\xbb", "À bientôt, ça va très bien… «merci»"},
+		{"windows-1252 spanish", "\xbfQu\xe9 pas\xf3? \xa1Ma\xf1ana!", "¿Qué pasó? ¡Mañana!"},
+		{"windows-1251 russian", "\xcf\xf0\xe8\xe2\xe5\xf2, \xea\xe0\xea \xe4\xe5\xeb\xe0?", "Привет, как дела?"},
+		{"windows-1251 ukrainian", "\xaf\xe6\xe0\xea \xbf\xf1\xf2\xfc \xff\xe1\xeb\xf3\xea\xee", "Їжак їсть яблуко"},
+		{"windows-1251 single letter", "\xdf", "Я"},
+	}
+	for _, tt := range tests {
+		if got := decodeSubtitles([]byte(tt.in)); got != tt.want {
+			t.Errorf("%v: decodeSubtitles() = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestSRTToVTT(t *testing.T) {
+	tests := []struct {
+		name string
+		in   string
+		want string
+	}{
+		{
+			name: "windows-1251",
+			in: "1\r\n00:00:01,000 --> 00:00:03,500\r\n\xcf\xf0\xe8\xe2\xe5\xf2, \xea\xe0\xea \xe4\xe5\xeb\xe0?\r\n\r\n" +
+				"2\r\n00:00:04,000 --> 00:00:06,000\r\n<i>\xdf \xed\xe5 \xe7\xed\xe0\xfe, \xf7\xf2\xee \xf1\xea\xe0\xe7\xe0\xf2\xfc.</i>\r\n",
+			want: "WEBVTT\n\n00:00:01.000 --> 00:00:03.500\nПривет, как дела?\n\n" +
+				"00:00:04.000 --> 00:00:06.000\n<i>Я не знаю, что сказать.</i>\n\n",
+		},
+		{
+			name: "windows-1252",
+			in: "1\r\n00:00:01,000 --> 00:00:03,500\r\nDie Gr\xf6\xdfe ist sch\xf6n.\r\n\r\n" +
+				"2\r\n00:00:04,000 --> 00:00:06,000\r\n\xdcber den Flu\xdf, bitte.\r\n",
+			want: "WEBVTT\n\n00:00:01.000 --> 00:00:03.500\nDie Größe ist schön.\n\n" +
+				"00:00:04.000 --> 00:00:06.000\nÜber den Fluß, bitte.\n\n",
+		},
+		{
+			name: "font tags, arrows and empty cues",
+			in: "1\n00:01:02.5 --> 00:01:03.25\n<font color=\"red\">a --> b</font>\n\n" +
+				"2\n00:01:04,000 --> 00:01:05,000\n\n\n3\n1:00:00,000 --> 1:00:01,000\nlast\n",
+			want: "WEBVTT\n\n00:01:02.500 --> 00:01:03.250\na -> b\n\n" +
+				"01:00:00.000 --> 01:00:01.000\nlast\n\n",
+		},
+	}
+	for _, tt := range tests {
+		if got := srtToVTT(decodeSubtitles([]byte(tt.in))); got != tt.want {
+			t.Errorf("%v: srtToVTT() = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestASSToVTT(t *testing.T) {
+	tests := []struct {
+		name string
+		in   string
+		want string
+	}{
+		{
+			name: "default format",
+			in: "[Script Info]\nTitle: test\n\n[Events]\n" +
+				"Format: Layer, Start, End, Style, Name, MarginL, MarginR, MarginV, Effect, Text\n" +
+				"Dialogue: 0,0:00:01.50,0:00:03.00,Default,,0,0,0,,{\\i1}Hello,\\Nworld{\\i0}\n" +
+				"Comment: 0,0:00:04.00,0:00:05.00,Default,,0,0,0,,skipped\n",
+			want: "WEBVTT\n\n00:00:01.500 --> 00:00:03.000\nHello,\nworld\n\n",
+		},
+		{
+			name: "custom format order",
+			in: "[Events]\nFormat: Start, End, Text\n" +
+				"Dialogue: 0:01:00.00,0:01:02.10,a\\hb\n" +
+				"Dialogue: 0:01:03.00,0:01:04.00,{\\pos(1,1)}\n",
+			want: "WEBVTT\n\n00:01:00.000 --> 00:01:02.100\na b\n\n",
+		},
+		{
+			name: "no events",
+			in:   "[V4+ Styles]\nDialogue: 0,0:00:01.00,0:00:02.00,Default,,0,0,0,,text\n",
+			want: "WEBVTT\n\n",
+		},
+	}
+	for _, tt := range tests {
+		if got := assToVTT(tt.in); got != tt.want {
+			t.Errorf("%v: assToVTT() = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestVTTDuration(t *testing.T) {
+	tests := []struct {
+		in   string
+		want float64
+	}{
+		{"WEBVTT\n\n", 0},
+		{"WEBVTT\n\n00:00:01.000 --> 00:00:03.500\na\n\n00:00:02.000 --> 00:00:02.500\nb\n\n", 3.5},
+		{"WEBVTT\n\n00:01.000 --> 01:02.250\na\n\n", 62.25},
+		{"WEBVTT\n\n01:00:00.000 --> 01:00:01.000\na\n\n", 3601},
+	}
+	for _, tt := range tests {
+		if got := vttDuration(tt.in); got != tt.want {
+			t.Errorf("vttDuration(%q) = %v, want %v", tt.in, got, tt.want)
+		}
+	}
+}
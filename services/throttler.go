@@ -0,0 +1,299 @@
+package services
+
+import (
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/urfave/cli"
+)
+
+const (
+	maxConnsPerIPFlag  = "max-conns-per-ip"
+	maxConnsPerKeyFlag = "max-conns-per-key"
+	playlistRateFlag   = "playlist-rate"
+	segmentRateFlag    = "segment-rate"
+	rateBurstFlag      = "rate-burst"
+	realIPHeaderFlag   = "real-ip-header"
+	trustedProxiesFlag = "trusted-proxies"
+	throttlerIdle      = 10 * time.Minute
+)
+
+func RegisterThrottlerFlags(c *cli.App) {
+	c.Flags = append(c.Flags, cli.IntFlag{
+		Name:   maxConnsPerIPFlag,
+		Usage:  "max concurrent content connections per client IP (0 is unlimited)",
+		Value:  0,
+		EnvVar: "MAX_CONNS_PER_IP",
+	})
+	c.Flags = append(c.Flags, cli.IntFlag{
+		Name:   maxConnsPerKeyFlag,
+		Usage:  "max concurrent content connections per cache key (0 is unlimited)",
+		Value:  0,
+		EnvVar: "MAX_CONNS_PER_KEY",
+	})
+	c.Flags = append(c.Flags, cli.Int64Flag{
+		Name:   playlistRateFlag,
+		Usage:  "playlist bytes per second per client IP (0 is unlimited)",
+		Value:  0,
+		EnvVar: "PLAYLIST_RATE",
+	})
+	c.Flags = append(c.Flags, cli.Int64Flag{
+		Name:   segmentRateFlag,
+		Usage:  "segment bytes per second per client IP (0 is unlimited)",
+		Value:  0,
+		EnvVar: "SEGMENT_RATE",
+	})
+	c.Flags = append(c.Flags, cli.Int64Flag{
+		Name:   rateBurstFlag,
+		Usage:  "burst bytes allowed above rate",
+		Value:  8 * 1024 * 1024,
+		EnvVar: "RATE_BURST",
+	})
+	c.Flags = append(c.Flags, cli.StringFlag{
+		Name:   realIPHeaderFlag,
+		Usage:  "header with real client IP, e.g. X-Real-IP or X-Forwarded-For (RemoteAddr is used if empty)",
+		Value:  "",
+		EnvVar: "REAL_IP_HEADER",
+	})
+	c.Flags = append(c.Flags, cli.IntFlag{
+		Name:   trustedProxiesFlag,
+		Usage:  "number of trusted proxies appending to real IP header, client IP is taken from the entry added by the farthest of them",
+		Value:  1,
+		EnvVar: "TRUSTED_PROXIES",
+	})
+}
+
+// tokenBucket limits rate of bytes with burst allowance
+type tokenBucket struct {
+	mux    sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(rate int64, burst int64) *tokenBucket {
+	return &tokenBucket{
+		rate:   float64(rate),
+		burst:  float64(burst),
+		tokens: float64(burst),
+		last:   time.Now(),
+	}
+}
+
+// take reserves n tokens and returns time to wait before using them
+func (s *tokenBucket) take(n int) time.Duration {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	now := time.Now()
+	s.tokens += now.Sub(s.last).Seconds() * s.rate
+	if s.tokens > s.burst {
+		s.tokens = s.burst
+	}
+	s.last = now
+	s.tokens -= float64(n)
+	if s.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-s.tokens / s.rate * float64(time.Second))
+}
+
+// throttleBuckets keeps rate limits of client between its connections
+type throttleBuckets struct {
+	playlist *tokenBucket
+	segment  *tokenBucket
+	last     time.Time
+}
+
+// Throttler limits concurrent connections per client and cache key
+// and rate of response bytes per client
+type Throttler struct {
+	mux          sync.Mutex
+	maxPerIP     int
+	maxPerKey    int
+	playlistRate int64
+	segmentRate  int64
+	burst        int64
+	ipHeader     string
+	proxies      int
+	conns        map[string]int
+	keys         map[string]int
+	buckets      map[string]*throttleBuckets
+	idle         time.Duration
+	swept        time.Time
+}
+
+func NewThrottler(c *cli.Context) *Throttler {
+	s := &Throttler{
+		maxPerIP:     c.Int(maxConnsPerIPFlag),
+		maxPerKey:    c.Int(maxConnsPerKeyFlag),
+		playlistRate: c.Int64(playlistRateFlag),
+		segmentRate:  c.Int64(segmentRateFlag),
+		burst:        c.Int64(rateBurstFlag),
+		ipHeader:     c.String(realIPHeaderFlag),
+		proxies:      c.Int(trustedProxiesFlag),
+		conns:        map[string]int{},
+		keys:         map[string]int{},
+		buckets:      map[string]*throttleBuckets{},
+		idle:         throttlerIdle,
+		swept:        time.Now(),
+	}
+	// buckets are dropped only when they would be refilled anyway
+	for _, rate := range []int64{s.playlistRate, s.segmentRate} {
+		if rate > 0 {
+			if d := time.Duration(float64(s.burst) / float64(rate) * float64(time.Second)); d > s.idle {
+				s.idle = d
+			}
+		}
+	}
+	return s
+}
+
+// ClientIP returns client IP of the request. Values of real IP header are
+// appended by proxies, so only the entry added by the farthest trusted proxy
+// is used, entries to the left of it are controlled by client.
+func (s *Throttler) ClientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	if s.ipHeader == "" || s.proxies <= 0 {
+		return host
+	}
+	vv := []string{}
+	for _, h := range r.Header.Values(s.ipHeader) {
+		for _, v := range strings.Split(h, ",") {
+			if v = strings.TrimSpace(v); v != "" {
+				vv = append(vv, v)
+			}
+		}
+	}
+	if len(vv) < s.proxies {
+		return host
+	}
+	return vv[len(vv)-s.proxies]
+}
+
+func isPlaylistPath(path string) bool {
+	return strings.HasSuffix(path, ".m3u8") || strings.HasSuffix(path, ".mpd")
+}
+
+// sweep drops buckets of clients idle long enough to refill them
+func (s *Throttler) sweep(now time.Time) {
+	if now.Sub(s.swept) < s.idle {
+		return
+	}
+	s.swept = now
+	for ip, b := range s.buckets {
+		if s.conns[ip] == 0 && now.Sub(b.last) > s.idle {
+			delete(s.buckets, ip)
+		}
+	}
+}
+
+// Acquire registers connection of the client to the key, returns
+// throttled writer and release func, or false if limits are exceeded
+func (s *Throttler) Acquire(w http.ResponseWriter, r *http.Request, key string) (http.ResponseWriter, func(), bool) {
+	ip := s.ClientIP(r)
+	now := time.Now()
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	if s.maxPerIP > 0 && s.conns[ip] >= s.maxPerIP {
+		return nil, nil, false
+	}
+	if s.maxPerKey > 0 && s.keys[key] >= s.maxPerKey {
+		return nil, nil, false
+	}
+	s.conns[ip]++
+	s.keys[key]++
+	s.sweep(now)
+	tb, ok := s.buckets[ip]
+	if !ok {
+		tb = &throttleBuckets{}
+		s.buckets[ip] = tb
+	}
+	tb.last = now
+	release := func() {
+		s.mux.Lock()
+		defer s.mux.Unlock()
+		tb.last = time.Now()
+		s.conns[ip]--
+		if s.conns[ip] == 0 {
+			delete(s.conns, ip)
+		}
+		s.keys[key]--
+		if s.keys[key] == 0 {
+			delete(s.keys, key)
+		}
+	}
+	var b *tokenBucket
+	if isPlaylistPath(r.URL.Path) && s.playlistRate > 0 {
+		if tb.playlist == nil {
+			tb.playlist = newTokenBucket(s.playlistRate, s.burst)
+		}
+		b = tb.playlist
+	} else if !isPlaylistPath(r.URL.Path) && s.segmentRate > 0 {
+		if tb.segment == nil {
+			tb.segment = newTokenBucket(s.segmentRate, s.burst)
+		}
+		b = tb.segment
+	}
+	if b == nil {
+		return w, release, true
+	}
+	return &throttledResponseWriter{
+		ResponseWriter: w,
+		b:              b,
+		chunk:          int(s.burst),
+		r:              r,
+	}, release, true
+}
+
+type throttledResponseWriter struct {
+	http.ResponseWriter
+	b     *tokenBucket
+	chunk int
+	r     *http.Request
+}
+
+func (w *throttledResponseWriter) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		n := len(p)
+		if w.chunk > 0 && n > w.chunk {
+			n = w.chunk
+		}
+		if d := w.b.take(n); d > 0 {
+			select {
+			case <-time.After(d):
+			case <-w.r.Context().Done():
+				return written, w.r.Context().Err()
+			}
+		}
+		nn, err := w.ResponseWriter.Write(p[:n])
+		written += nn
+		if err != nil {
+			return written, err
+		}
+		p = p[n:]
+	}
+	return written, nil
+}
+
+func (w *throttledResponseWriter) Flush() {
+	f, ok := w.ResponseWriter.(http.Flusher)
+	if !ok {
+		return
+	}
+
+	f.Flush()
+}
+
+// Check interface implementations.
+var (
+	_ http.ResponseWriter = &throttledResponseWriter{}
+	_ http.Flusher        = &throttledResponseWriter{}
+)
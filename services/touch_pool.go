@@ -4,34 +4,118 @@ import (
 	"context"
 	"sync"
 	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/urfave/cli"
 )
 
 const (
-	touchTTL = 60
+	touchIntervalFlag    = "touch-interval"
+	touchConcurrencyFlag = "touch-concurrency"
+	touchTimeout         = 30
 )
 
+func RegisterTouchPoolFlags(c *cli.App) {
+	c.Flags = append(c.Flags, cli.DurationFlag{
+		Name:   touchIntervalFlag,
+		Usage:  "interval between touch flushes",
+		Value:  60 * time.Second,
+		EnvVar: "TOUCH_INTERVAL",
+	})
+	c.Flags = append(c.Flags, cli.IntFlag{
+		Name:   touchConcurrencyFlag,
+		Usage:  "max concurrent touch writes during flush",
+		Value:  10,
+		EnvVar: "TOUCH_CONCURRENCY",
+	})
+}
+
+// TouchPool records touches in memory and flushes them
+// to storage in background once per interval
 type TouchPool struct {
-	sm     sync.Map
-	st     *S3Storage
-	expire time.Duration
+	sink     TouchSink
+	mux      sync.Mutex
+	pending  map[string]int
+	interval time.Duration
+	c        int
+	closeCh  chan bool
+	doneCh   chan bool
+	closed   bool
+}
+
+func NewTouchPool(c *cli.Context, sink TouchSink) *TouchPool {
+	tp := &TouchPool{
+		sink:     sink,
+		pending:  map[string]int{},
+		interval: c.Duration(touchIntervalFlag),
+		c:        c.Int(touchConcurrencyFlag),
+		closeCh:  make(chan bool),
+		doneCh:   make(chan bool),
+	}
+	go tp.run()
+	return tp
 }
 
-func NewTouchPool(st *S3Storage) *TouchPool {
-	return &TouchPool{
-		expire: time.Duration(touchTTL) * time.Second,
-		st:     st,
+func (s *TouchPool) Touch(key string) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	s.pending[key]++
+}
+
+func (s *TouchPool) run() {
+	defer close(s.doneCh)
+	t := time.NewTicker(s.interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+			s.flush()
+		case <-s.closeCh:
+			s.flush()
+			return
+		}
+	}
+}
+
+func (s *TouchPool) flush() {
+	s.mux.Lock()
+	keys := s.pending
+	s.pending = map[string]int{}
+	s.mux.Unlock()
+	if len(keys) == 0 {
+		return
+	}
+	log.Infof("flushing touches count=%v", len(keys))
+	sem := make(chan bool, s.c)
+	var wg sync.WaitGroup
+	for k, h := range keys {
+		sem <- true
+		wg.Add(1)
+		go func(k string, h int) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+			ctx, cancel := context.WithTimeout(context.Background(), touchTimeout*time.Second)
+			defer cancel()
+			err := s.sink.Touch(ctx, k, h)
+			if err != nil {
+				log.WithError(err).Error("failed to touch")
+			}
+		}(k, h)
 	}
+	wg.Wait()
 }
 
-func (s *TouchPool) Touch(key string) error {
-	_, loaded := s.sm.LoadOrStore(key, true)
-	if !loaded {
-		t := NewToucher(context.Background(), s.st, key)
-		go func() {
-			<-time.After(s.expire)
-			s.sm.Delete(key)
-		}()
-		return t.Touch()
+// Close flushes pending touches and stops background worker
+func (s *TouchPool) Close() {
+	s.mux.Lock()
+	if s.closed {
+		s.mux.Unlock()
+		return
 	}
-	return nil
+	s.closed = true
+	s.mux.Unlock()
+	close(s.closeCh)
+	<-s.doneCh
 }
@@ -0,0 +1,98 @@
+package services
+
+import (
+	"context"
+	"time"
+
+	"github.com/go-redis/redis"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"github.com/urfave/cli"
+	cs "github.com/webtor-io/common-services"
+)
+
+const (
+	touchSinkFlag        = "touch-sink"
+	touchRedisPrefixFlag = "touch-redis-prefix"
+	touchSinkS3          = "s3"
+	touchSinkRedis       = "redis"
+)
+
+// TouchSink records access to cache key
+type TouchSink interface {
+	Touch(ctx context.Context, key string, hits int) error
+}
+
+func RegisterTouchSinkFlags(c *cli.App) {
+	c.Flags = append(c.Flags, cli.StringFlag{
+		Name:   touchSinkFlag,
+		Usage:  "touch sink (s3, redis)",
+		Value:  touchSinkS3,
+		EnvVar: "TOUCH_SINK",
+	})
+	c.Flags = append(c.Flags, cli.StringFlag{
+		Name:   touchRedisPrefixFlag,
+		Usage:  "redis key prefix of touch sorted sets",
+		Value:  "transcode-web-cache:touch",
+		EnvVar: "TOUCH_REDIS_PREFIX",
+	})
+}
+
+func UseRedisTouchSink(c *cli.Context) bool {
+	return c.String(touchSinkFlag) == touchSinkRedis
+}
+
+func NewTouchSink(c *cli.Context, st *S3Storage, rcl *cs.RedisClient) (TouchSink, error) {
+	switch c.String(touchSinkFlag) {
+	case touchSinkS3:
+		return NewS3TouchSink(st), nil
+	case touchSinkRedis:
+		return NewRedisTouchSink(c, rcl), nil
+	}
+	return nil, errors.Errorf("unknown touch sink %v", c.String(touchSinkFlag))
+}
+
+// S3TouchSink writes touch/<key> objects to the bucket
+type S3TouchSink struct {
+	st *S3Storage
+}
+
+func NewS3TouchSink(st *S3Storage) *S3TouchSink {
+	return &S3TouchSink{
+		st: st,
+	}
+}
+
+func (s *S3TouchSink) Touch(ctx context.Context, key string, hits int) error {
+	return s.st.Touch(ctx, key)
+}
+
+// RedisTouchSink keeps last access timestamps in <prefix>:access
+// and hit counters in <prefix>:hits sorted sets
+type RedisTouchSink struct {
+	cl     *cs.RedisClient
+	prefix string
+}
+
+func NewRedisTouchSink(c *cli.Context, cl *cs.RedisClient) *RedisTouchSink {
+	return &RedisTouchSink{
+		cl:     cl,
+		prefix: c.String(touchRedisPrefixFlag),
+	}
+}
+
+func (s *RedisTouchSink) Touch(ctx context.Context, key string, hits int) error {
+	log.Infof("touching redis prefix=%v key=%v hits=%v", s.prefix, key, hits)
+	p := s.cl.Get().Pipeline()
+	defer p.Close()
+	p.ZAdd(s.prefix+":access", redis.Z{
+		Score:  float64(time.Now().Unix()),
+		Member: key,
+	})
+	p.ZIncrBy(s.prefix+":hits", float64(hits), key)
+	_, err := p.Exec()
+	if err != nil {
+		return errors.Wrapf(err, "failed to touch redis prefix=%v key=%v", s.prefix, key)
+	}
+	return nil
+}
@@ -0,0 +1,134 @@
+package services
+
+import (
+	"context"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/urfave/cli"
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+	"go.opentelemetry.io/otel/trace/noop"
+)
+
+const (
+	traceExporterFlag    = "trace-exporter"
+	traceOTLPEndpoint    = "trace-otlp-endpoint"
+	traceServiceNameFlag = "trace-service-name"
+	traceSampleRatioFlag = "trace-sample-ratio"
+	traceExporterStdout  = "stdout"
+	traceExporterOTLP    = "otlp"
+	tracerName           = "github.com/webtor-io/transcode-web-cache"
+	traceShutdownTimeout = 10 * time.Second
+)
+
+func RegisterTracerFlags(c *cli.App) {
+	c.Flags = append(c.Flags, cli.StringFlag{
+		Name:   traceExporterFlag,
+		Usage:  "trace exporter (stdout, otlp), tracing is disabled if empty",
+		Value:  "",
+		EnvVar: "TRACE_EXPORTER",
+	})
+	c.Flags = append(c.Flags, cli.StringFlag{
+		Name:   traceOTLPEndpoint,
+		Usage:  "OTLP/HTTP traces endpoint",
+		Value:  "http://localhost:4318/v1/traces",
+		EnvVar: "OTEL_EXPORTER_OTLP_TRACES_ENDPOINT",
+	})
+	c.Flags = append(c.Flags, cli.StringFlag{
+		Name:   traceServiceNameFlag,
+		Usage:  "service name reported in traces",
+		Value:  "transcode-web-cache",
+		EnvVar: "OTEL_SERVICE_NAME",
+	})
+	c.Flags = append(c.Flags, cli.Float64Flag{
+		Name:   traceSampleRatioFlag,
+		Usage:  "ratio of sampled root traces",
+		Value:  1,
+		EnvVar: "TRACE_SAMPLE_RATIO",
+	})
+}
+
+// Tracer starts spans with OpenTelemetry tracer provider
+// and propagates W3C trace context, it is no-op if tracing is disabled
+type Tracer struct {
+	trace.Tracer
+	tp   trace.TracerProvider
+	sdk  *sdktrace.TracerProvider
+	prop propagation.TextMapPropagator
+}
+
+func NewTracer(c *cli.Context) (*Tracer, error) {
+	t := &Tracer{
+		tp:   noop.NewTracerProvider(),
+		prop: propagation.TraceContext{},
+	}
+	var exp sdktrace.SpanExporter
+	var err error
+	switch c.String(traceExporterFlag) {
+	case "":
+	case traceExporterStdout:
+		exp, err = stdouttrace.New(stdouttrace.WithWriter(os.Stdout))
+	case traceExporterOTLP:
+		exp, err = otlptracehttp.New(context.Background(), otlptracehttp.WithEndpointURL(c.String(traceOTLPEndpoint)))
+	default:
+		return nil, errors.Errorf("unknown trace exporter %v", c.String(traceExporterFlag))
+	}
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to create trace exporter %v", c.String(traceExporterFlag))
+	}
+	if exp != nil {
+		t.sdk = sdktrace.NewTracerProvider(
+			sdktrace.WithBatcher(exp),
+			sdktrace.WithResource(resource.NewSchemaless(attribute.String("service.name", c.String(traceServiceNameFlag)))),
+			sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(c.Float64(traceSampleRatioFlag)))),
+		)
+		t.tp = t.sdk
+	}
+	t.Tracer = t.tp.Tracer(tracerName)
+	return t, nil
+}
+
+// Handler traces incoming requests continuing propagated trace context
+func (s *Tracer) Handler(h http.Handler) http.Handler {
+	return otelhttp.NewHandler(h, "web",
+		otelhttp.WithTracerProvider(s.tp),
+		otelhttp.WithPropagators(s.prop),
+	)
+}
+
+// Transport traces outgoing requests and propagates trace context into them
+func (s *Tracer) Transport(rt http.RoundTripper) http.RoundTripper {
+	return otelhttp.NewTransport(rt,
+		otelhttp.WithTracerProvider(s.tp),
+		otelhttp.WithPropagators(s.prop),
+	)
+}
+
+// Close exports pending spans
+func (s *Tracer) Close() {
+	if s.sdk == nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), traceShutdownTimeout)
+	defer cancel()
+	s.sdk.Shutdown(ctx)
+}
+
+// setSpanError marks span as failed, nil error is ignored
+func setSpanError(sp trace.Span, err error) {
+	if err == nil {
+		return
+	}
+	sp.RecordError(err)
+	sp.SetStatus(codes.Error, err.Error())
+}
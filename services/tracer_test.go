@@ -0,0 +1,60 @@
+package services
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+)
+
+func TestTracerPropagation(t *testing.T) {
+	tp := sdktrace.NewTracerProvider()
+	tr := &Tracer{Tracer: tp.Tracer(tracerName), tp: tp, sdk: tp, prop: propagation.TraceContext{}}
+	defer tr.Close()
+	const traceID = "4bf92f3577b34da6a3ce929d0e0e4736"
+	tests := []struct {
+		name    string
+		parent  string
+		sampled bool
+	}{
+		{"sampled parent", "00-" + traceID + "-00f067aa0ba902b7-01", true},
+		{"unsampled parent", "00-" + traceID + "-00f067aa0ba902b7-00", false},
+	}
+	for _, tt := range tests {
+		var out http.Header
+		origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			out = r.Header.Clone()
+		}))
+		cl := &http.Client{Transport: tr.Transport(http.DefaultTransport)}
+		h := tr.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			req, _ := http.NewRequestWithContext(r.Context(), http.MethodGet, origin.URL, nil)
+			res, err := cl.Do(req)
+			if err != nil {
+				t.Fatalf("%v: %v", tt.name, err)
+			}
+			res.Body.Close()
+		}))
+		r := httptest.NewRequest(http.MethodGet, "/k/v0.m3u8", nil)
+		r.Header.Set("traceparent", tt.parent)
+		r.Header.Set("tracestate", "vendor=value")
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		origin.Close()
+		p := out.Get("traceparent")
+		if !strings.HasPrefix(p, "00-"+traceID+"-") {
+			t.Errorf("%v: outgoing traceparent = %q, want trace id %v", tt.name, p, traceID)
+		}
+		if sampled := strings.HasSuffix(p, "-01"); sampled != tt.sampled {
+			t.Errorf("%v: outgoing traceparent = %q, want sampled %v", tt.name, p, tt.sampled)
+		}
+		if ts := out.Get("tracestate"); ts != "vendor=value" {
+			t.Errorf("%v: outgoing tracestate = %q, want %q", tt.name, ts, "vendor=value")
+		}
+		if v := w.Header().Get("traceparent"); v != "" {
+			t.Errorf("%v: response has traceparent %q", tt.name, v)
+		}
+	}
+}
@@ -0,0 +1,129 @@
+package services
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"github.com/urfave/cli"
+	"github.com/webtor-io/lazymap"
+)
+
+const (
+	transcodeWebhookURLFlag      = "transcode-webhook-url"
+	transcodeWebhookCooldownFlag = "transcode-webhook-cooldown"
+	transcodeRetryAfterFlag      = "transcode-retry-after"
+)
+
+func RegisterTranscodeTriggerFlags(c *cli.App) {
+	c.Flags = append(c.Flags, cli.StringFlag{
+		Name:   transcodeWebhookURLFlag,
+		Usage:  "webhook called to start transcoding when content is not done",
+		Value:  "",
+		EnvVar: "TRANSCODE_WEBHOOK_URL",
+	})
+	c.Flags = append(c.Flags, cli.DurationFlag{
+		Name:   transcodeWebhookCooldownFlag,
+		Usage:  "min time between webhook calls for the same key",
+		Value:  5 * time.Minute,
+		EnvVar: "TRANSCODE_WEBHOOK_COOLDOWN",
+	})
+	c.Flags = append(c.Flags, cli.IntFlag{
+		Name:   transcodeRetryAfterFlag,
+		Usage:  "Retry-After seconds returned while transcoding",
+		Value:  10,
+		EnvVar: "TRANSCODE_RETRY_AFTER",
+	})
+}
+
+type transcodeRequest struct {
+	Key        string `json:"key"`
+	Prefix     string `json:"prefix"`
+	InfoHash   string `json:"info_hash"`
+	OriginPath string `json:"origin_path"`
+}
+
+// TranscodeTrigger calls webhook to start transcoding of missing content,
+// calls are deduplicated per key for cooldown period
+type TranscodeTrigger struct {
+	lazymap.LazyMap
+	url        string
+	retryAfter int
+	cl         *http.Client
+}
+
+func NewTranscodeTrigger(c *cli.Context, cl *http.Client) *TranscodeTrigger {
+	return &TranscodeTrigger{
+		url:        c.String(transcodeWebhookURLFlag),
+		retryAfter: c.Int(transcodeRetryAfterFlag),
+		cl:         cl,
+		LazyMap: lazymap.New(&lazymap.Config{
+			Concurrency: 10,
+			Expire:      c.Duration(transcodeWebhookCooldownFlag),
+			Capacity:    10000,
+		}),
+	}
+}
+
+func (s *TranscodeTrigger) Enabled() bool {
+	return s.url != ""
+}
+
+func (s *TranscodeTrigger) RetryAfter() int {
+	return s.retryAfter
+}
+
+// Trigger calls webhook in background and reports whether it was fired
+// by this invocation, calls suppressed by cooldown are not reported
+func (s *TranscodeTrigger) Trigger(key string, prefix string, hash string, originPath string) bool {
+	if !s.Enabled() || hash == "" {
+		return false
+	}
+	fired := false
+	s.LazyMap.Get(key, func() (interface{}, error) {
+		fired = true
+		go func() {
+			err := s.call(&transcodeRequest{
+				Key:        key,
+				Prefix:     prefix,
+				InfoHash:   hash,
+				OriginPath: originPath,
+			})
+			if err != nil {
+				log.WithError(err).Errorf("failed to trigger transcoding key=%v", key)
+			}
+		}()
+		return nil, nil
+	})
+	return fired
+}
+
+func (s *TranscodeTrigger) call(tr *transcodeRequest) error {
+	log.Infof("triggering transcoding key=%v hash=%v path=%v", tr.Key, tr.InfoHash, tr.OriginPath)
+	b, err := json.Marshal(tr)
+	if err != nil {
+		return errors.Wrap(err, "failed to marshal transcode request")
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.url, bytes.NewReader(b))
+	if err != nil {
+		return errors.Wrap(err, "failed to create webhook request")
+	}
+	req.Header.Set("Content-Type", "application/json")
+	res, err := s.cl.Do(req)
+	if err != nil {
+		return errors.Wrapf(err, "failed to call webhook url=%v", s.url)
+	}
+	defer res.Body.Close()
+	io.Copy(io.Discard, res.Body)
+	if res.StatusCode >= 300 {
+		return errors.Errorf("webhook failed url=%v status=%v", s.url, res.StatusCode)
+	}
+	return nil
+}
@@ -1,49 +1,115 @@
 package services
 
 import (
+	"context"
 	"crypto/sha1"
+	"crypto/tls"
+	"encoding/json"
+	"expvar"
 	"fmt"
+	"io"
 	"net"
 	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/pkg/errors"
 	log "github.com/sirupsen/logrus"
 	"github.com/urfave/cli"
+	"go.opentelemetry.io/otel/attribute"
 )
 
 const (
-	webHostFlag    = "host"
-	webPortFlag    = "port"
-	keyPrefixFlag  = "key-prefix"
-	originPathFlag = "origin-path"
-	infoHashFlag   = "info-hash"
-	playerFlag     = "player"
+	webHostFlag              = "host"
+	webPortFlag              = "port"
+	keyPrefixFlag            = "key-prefix"
+	originPathFlag           = "origin-path"
+	infoHashFlag             = "info-hash"
+	playerFlag               = "player"
+	accessLogFlag            = "access-log"
+	tlsCertFlag              = "tls-cert"
+	tlsKeyFlag               = "tls-key"
+	redirectPortFlag         = "https-redirect-port"
+	cacheControlPlaylistFlag = "cache-control-playlist"
+	cacheControlSegmentFlag  = "cache-control-segment"
+	cacheControlNotDoneFlag  = "cache-control-not-done"
+	adminHostFlag            = "admin-host"
+	adminPortFlag            = "admin-port"
 )
 
 type Web struct {
 	host string
 	port int
+	ah   string
+	ap   int
+	aln  net.Listener
 	kp   string
 	op   string
 	ih   string
-	c    *LookaheadCache
+	c    ContentCache
 	tp   *TouchPool
 	dp   *DonePool
+	st   *Stats
+	th   *Throttler
+	rl   *RateLimiter
+	or   *OriginProxy
+	tt   *TranscodeTrigger
+	ci   *ContentInfoCache
+	ct   *ContentTypes
+	sc   *SubtitleConverter
+	ip   *IFramePlaylist
+	gens []ContentGenerator
 	ln   net.Listener
 	pl   bool
+	al   bool
+	cert string
+	key  string
+	rp   int
+	cr   *certReloader
+	rln  net.Listener
+	cors *CORS
+	tr   *Tracer
+	su   *SegmentURL
+	ccp  string
+	ccs  string
+	ccn  string
 }
 
-func NewWeb(c *cli.Context, ca *LookaheadCache, tp *TouchPool, dp *DonePool) *Web {
+func NewWeb(c *cli.Context, ca ContentCache, tp *TouchPool, dp *DonePool, st *Stats, th *Throttler, rl *RateLimiter, or *OriginProxy, tt *TranscodeTrigger, ci *ContentInfoCache, ct *ContentTypes, sc *SubtitleConverter, bp *ByteRangePlaylist, ip *IFramePlaylist, cors *CORS, tr *Tracer) *Web {
 	return &Web{
 		host: c.String(webHostFlag),
 		port: c.Int(webPortFlag),
+		ah:   c.String(adminHostFlag),
+		ap:   c.Int(adminPortFlag),
 		kp:   c.String(keyPrefixFlag),
 		op:   c.String(originPathFlag),
 		ih:   c.String(infoHashFlag),
 		pl:   c.Bool(playerFlag),
+		al:   c.BoolT(accessLogFlag),
+		cert: c.String(tlsCertFlag),
+		key:  c.String(tlsKeyFlag),
+		rp:   c.Int(redirectPortFlag),
+		cors: cors,
+		tr:   tr,
+		su:   NewSegmentURL(c),
+		ccp:  c.String(cacheControlPlaylistFlag),
+		ccs:  c.String(cacheControlSegmentFlag),
+		ccn:  c.String(cacheControlNotDoneFlag),
 		c:    ca,
 		tp:   tp,
 		dp:   dp,
+		st:   st,
+		th:   th,
+		rl:   rl,
+		or:   or,
+		tt:   tt,
+		ci:   ci,
+		ct:   ct,
+		sc:   sc,
+		ip:   ip,
+		gens: []ContentGenerator{ip, bp, sc},
 	}
 }
 
@@ -77,6 +143,59 @@ func RegisterWebFlags(c *cli.App) {
 		Name:  playerFlag,
 		Usage: "player",
 	})
+	c.Flags = append(c.Flags, cli.BoolTFlag{
+		Name:   accessLogFlag,
+		Usage:  "access log",
+		EnvVar: "ACCESS_LOG",
+	})
+	c.Flags = append(c.Flags, cli.StringFlag{
+		Name:   tlsCertFlag,
+		Usage:  "TLS certificate path, enables HTTPS and HTTP/2",
+		Value:  "",
+		EnvVar: "TLS_CERT",
+	})
+	c.Flags = append(c.Flags, cli.StringFlag{
+		Name:   tlsKeyFlag,
+		Usage:  "TLS key path",
+		Value:  "",
+		EnvVar: "TLS_KEY",
+	})
+	c.Flags = append(c.Flags, cli.IntFlag{
+		Name:   redirectPortFlag,
+		Usage:  "HTTP listening port redirecting to HTTPS (0 disables redirect)",
+		Value:  0,
+		EnvVar: "HTTPS_REDIRECT_PORT",
+	})
+	c.Flags = append(c.Flags, cli.StringFlag{
+		Name:   cacheControlPlaylistFlag,
+		Usage:  "Cache-Control of playlists of done transcodes",
+		Value:  "public, max-age=3600",
+		EnvVar: "CACHE_CONTROL_PLAYLIST",
+	})
+	c.Flags = append(c.Flags, cli.StringFlag{
+		Name:   cacheControlSegmentFlag,
+		Usage:  "Cache-Control of segments of done transcodes",
+		Value:  "public, max-age=31536000, immutable",
+		EnvVar: "CACHE_CONTROL_SEGMENT",
+	})
+	c.Flags = append(c.Flags, cli.StringFlag{
+		Name:   cacheControlNotDoneFlag,
+		Usage:  "Cache-Control of responses for transcodes that are not done yet",
+		Value:  "no-store",
+		EnvVar: "CACHE_CONTROL_NOT_DONE",
+	})
+	c.Flags = append(c.Flags, cli.StringFlag{
+		Name:   adminHostFlag,
+		Usage:  "admin listening host",
+		Value:  "127.0.0.1",
+		EnvVar: "ADMIN_HOST",
+	})
+	c.Flags = append(c.Flags, cli.IntFlag{
+		Name:   adminPortFlag,
+		Usage:  "admin listening port serving metrics and stats (0 disables admin listener)",
+		Value:  0,
+		EnvVar: "ADMIN_PORT",
+	})
 }
 
 func (s *Web) getKeyPrefix(r *http.Request) string {
@@ -118,6 +237,130 @@ func (s *Web) getInfoHash(r *http.Request) string {
 	return ""
 }
 
+// validate checks request key inputs
+func (s *Web) validate(r *http.Request) bool {
+	ih := s.getInfoHash(r)
+	return ih == "" || infoHashRe.MatchString(ih)
+}
+
+// setVary adds Vary for headers used as key inputs
+func (s *Web) setVary(w http.ResponseWriter) {
+	if s.kp == "" {
+		w.Header().Add("Vary", "X-Key-Prefix")
+	}
+	if s.ih == "" {
+		w.Header().Add("Vary", "X-Info-Hash")
+	}
+	if s.op == "" {
+		w.Header().Add("Vary", "X-Origin-Path")
+	}
+}
+
+// setCacheControl sets Cache-Control according to content type and done state
+func (s *Web) setCacheControl(w http.ResponseWriter, r *http.Request, done bool) {
+	cc := s.ccn
+	if done && isPlaylistPath(r.URL.Path) {
+		cc = s.ccp
+	} else if done {
+		cc = s.ccs
+	}
+	if cc != "" {
+		w.Header().Set("Cache-Control", cc)
+	}
+}
+
+// generated reports whether missing content may be produced by generators
+func (s *Web) generated(p string) bool {
+	for _, g := range s.gens {
+		if g.Supports(p) {
+			return true
+		}
+	}
+	return false
+}
+
+// generate returns content produced by the first generator that has source for it
+func (s *Web) generate(ctx context.Context, key string, p string) (io.ReadSeekCloser, error) {
+	for _, g := range s.gens {
+		if !g.Supports(p) {
+			continue
+		}
+		c, err := g.Get(ctx, key, p)
+		if err != nil || c != nil {
+			return c, err
+		}
+	}
+	return nil, nil
+}
+
+// serveHead answers HEAD request from storage metadata without downloading content,
+// returns false if content may be produced by generators
+func (s *Web) serveHead(w http.ResponseWriter, r *http.Request, key string, t *time.Time) bool {
+	ci, err := s.ci.Get(r.Context(), key, r.URL.Path)
+	if err != nil {
+		log.WithError(err).Error("failed to get content info")
+		writeServerError(w, key, err)
+		return true
+	}
+	if ci == nil && s.generated(r.URL.Path) {
+		return false
+	}
+	if ci == nil {
+		s.setCacheControl(w, r, false)
+		writeAPIError(w, http.StatusNotFound, &APIError{
+			Code:    ErrCodeNotFound,
+			Message: "content not found",
+			Key:     key,
+		})
+		return true
+	}
+	etag := makeETag(key, r.URL.Path, t)
+	w.Header().Set("ETag", etag)
+	w.Header().Set("Last-Modified", t.UTC().Format(http.TimeFormat))
+	w.Header().Set("Accept-Ranges", "bytes")
+	s.setCacheControl(w, r, true)
+	if ct := s.ct.Get(r.URL.Path, ci.ContentType); ct != "" {
+		w.Header().Set("Content-Type", ct)
+	}
+	if etagMatch(r.Header.Get("If-None-Match"), etag) {
+		w.WriteHeader(http.StatusNotModified)
+		return true
+	}
+	w.Header().Set("Content-Length", strconv.FormatInt(ci.Size, 10))
+	w.WriteHeader(http.StatusOK)
+	return true
+}
+
+func writeInvalidRequest(w http.ResponseWriter) {
+	writeAPIError(w, http.StatusBadRequest, &APIError{
+		Code:    ErrCodeInvalidRequest,
+		Message: "invalid info hash",
+	})
+}
+
+// writeNotDone answers 202 if transcoding was triggered by the request and 425 otherwise
+func (s *Web) writeNotDone(w http.ResponseWriter, key string, started bool) {
+	if started {
+		writeAPIError(w, http.StatusAccepted, &APIError{
+			Code:       ErrCodeTranscoding,
+			Message:    "transcoding started",
+			Key:        key,
+			RetryAfter: s.tt.RetryAfter(),
+		})
+		return
+	}
+	writeAPIError(w, http.StatusTooEarly, &APIError{
+		Code:       ErrCodeNotDone,
+		Message:    "transcoding is not done yet",
+		Key:        key,
+		RetryAfter: s.tt.RetryAfter(),
+	})
+}
+
+func makeETag(key string, path string, t *time.Time) string {
+	return fmt.Sprintf(`"%x"`, sha1.Sum([]byte(key+path+t.String())))
+}
+
 func (s *Web) getKey(r *http.Request) string {
 	key := fmt.Sprintf("%x", sha1.Sum([]byte(s.getKeyPrefix(r)+s.getInfoHash(r)+s.getOriginPath(r))))
 	return key
@@ -129,65 +372,295 @@ func (s *Web) Serve() error {
 	if err != nil {
 		return errors.Wrap(err, "failed to web listen to tcp connection")
 	}
+	s.ln = ln
+	scheme := "http"
+	if s.cert != "" {
+		scheme = "https"
+	}
 	mux := http.NewServeMux()
 	if s.pl {
-		log.Info(fmt.Sprintf("Player available at http://%v/player/", addr))
+		log.Info(fmt.Sprintf("Player available at %v://%v/player/", scheme, addr))
 		mux.Handle("/player/", http.StripPrefix("/player/", http.FileServer(http.Dir("./player"))))
 	}
-	mux.HandleFunc("/done", func(w http.ResponseWriter, r *http.Request) {
-		done, _, err := s.dp.Done(s.getKey(r))
-		w.Header().Set("X-Cache-Key", s.getKey(r))
+	mux.HandleFunc("/done", s.rl.Handler(func(w http.ResponseWriter, r *http.Request) {
+		if !s.validate(r) {
+			writeInvalidRequest(w)
+			return
+		}
+		key := s.getKey(r)
+		m, err := s.dp.Marker(key)
+		w.Header().Set("X-Cache-Key", key)
+		s.setVary(w)
+		setAccessLogKey(r, key)
 		if err != nil {
 			log.WithError(err).Error("failed to check done marker")
-			w.WriteHeader(http.StatusInternalServerError)
+			writeServerError(w, key, err)
 			return
 		}
-		if !done {
-			w.WriteHeader(http.StatusNotFound)
+		if m == nil {
+			s.setCacheControl(w, r, false)
+			if s.tt.Enabled() && s.getInfoHash(r) == "" {
+				writeInvalidRequest(w)
+				return
+			}
+			started := s.tt.Trigger(key, s.getKeyPrefix(r), s.getInfoHash(r), s.getOriginPath(r))
+			s.writeNotDone(w, key, started)
+			return
+		}
+		w.Header().Set("Cache-Control", s.ccp)
+		b, err := json.Marshal(m)
+		if err != nil {
+			log.WithError(err).Error("failed to marshal done marker")
+			writeServerError(w, key, err)
 			return
 		}
+		w.Header().Set("Content-Type", "application/json")
 		w.WriteHeader(http.StatusOK)
-	})
-	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		w.Write(b)
+	}))
+	mux.HandleFunc("/", s.rl.Handler(func(w http.ResponseWriter, r *http.Request) {
+		if !s.validate(r) {
+			writeInvalidRequest(w)
+			return
+		}
 		key := s.getKey(r)
 		w.Header().Set("X-Cache-Key", key)
+		setAccessLogKey(r, key)
+		s.setVary(w)
+		if r.Method == http.MethodOptions {
+			w.Header().Set("Allow", "GET, HEAD, OPTIONS")
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		_, dsp := s.tr.Start(r.Context(), "done_pool.done")
 		d, t, err := s.dp.Done(s.getKey(r))
+		setSpanError(dsp, err)
+		dsp.End()
 		if err != nil {
 			log.WithError(err).Error("failed to check done marker")
-			w.WriteHeader(http.StatusInternalServerError)
+			writeServerError(w, key, err)
+			return
+		}
+		if !d && s.or.Enabled() {
+			s.tt.Trigger(key, s.getKeyPrefix(r), s.getInfoHash(r), s.getOriginPath(r))
+			setAccessLogCacheStatus(r, CacheStatusProxied)
+			s.setCacheControl(w, r, false)
+			s.or.Proxy(w, r, s.getKeyPrefix(r), s.getInfoHash(r), s.getOriginPath(r))
 			return
 		}
 		if !d {
+			s.setCacheControl(w, r, false)
 			log.Error("transcoding not done yet")
-			w.WriteHeader(http.StatusNotFound)
+			if s.tt.Enabled() && s.getInfoHash(r) == "" {
+				writeInvalidRequest(w)
+				return
+			}
+			started := s.tt.Trigger(key, s.getKeyPrefix(r), s.getInfoHash(r), s.getOriginPath(r))
+			s.writeNotDone(w, key, started)
 			return
 		}
-		c, err := s.c.Get(key, r.URL.Path)
+		if r.Method == http.MethodHead && s.serveHead(w, r, key, t) {
+			return
+		}
+		tw, release, ok := s.th.Acquire(w, r, key)
+		if !ok {
+			log.Warnf("too many connections path=%v key=%v ip=%v", r.URL.Path, key, s.th.ClientIP(r))
+			writeAPIError(w, http.StatusTooManyRequests, &APIError{
+				Code:       ErrCodeTooManyConns,
+				Message:    "too many concurrent connections",
+				Key:        key,
+				RetryAfter: 1,
+			})
+			return
+		}
+		defer release()
+		w = tw
+		c, cs, err := s.c.Get(r.Context(), key, r.URL.Path)
+		setAccessLogCacheStatus(r, cs)
 		if err != nil {
 			log.WithError(err).Error("failed to serve content")
-			w.WriteHeader(http.StatusInternalServerError)
+			writeServerError(w, key, err)
 			return
 		}
+		if c == nil {
+			c, err = s.generate(r.Context(), key, r.URL.Path)
+			if errors.Is(err, ErrGenerating) {
+				s.setCacheControl(w, r, false)
+				writeAPIError(w, http.StatusTooEarly, &APIError{
+					Code:       ErrCodeGenerating,
+					Message:    "content is being generated",
+					Key:        key,
+					RetryAfter: generatingRetryAfter,
+				})
+				return
+			}
+			if err != nil {
+				log.WithError(err).Error("failed to generate content")
+				writeServerError(w, key, err)
+				return
+			}
+		}
 		if c == nil {
 			log.Warnf("content not found path=%v hash=%v key=%v", s.getOriginPath(r), s.getInfoHash(r), key)
-			w.WriteHeader(http.StatusNotFound)
+			s.setCacheControl(w, r, false)
+			writeAPIError(w, http.StatusNotFound, &APIError{
+				Code:    ErrCodeNotFound,
+				Message: "content not found",
+				Key:     key,
+			})
 			return
 		}
 		defer c.Close()
-		http.ServeContent(w, r, "", *t, c)
-		go func() {
-			err := s.tp.Touch(key)
-			if err != nil {
-				log.WithError(err).Error("failed to touch")
-			}
-		}()
-	})
-	log.Infof("serving Web at %v", addr)
-	return http.Serve(ln, allowCORSHandler(enrichPlaylistHandler(mux)))
+		if s.ip.Enabled() && strings.HasSuffix(r.URL.Path, ".m3u8") {
+			setPlaylistIFrames(r)
+		}
+		if s.sc.Enabled() && strings.HasSuffix(r.URL.Path, ".m3u8") {
+			ctx := r.Context()
+			setPlaylistSubtitles(r, func() []SubtitleTrack {
+				tracks, err := s.sc.Tracks(ctx, key, path.Dir(r.URL.Path))
+				if err != nil {
+					log.WithError(err).Warn("failed to get subtitle tracks")
+				}
+				return tracks
+			})
+		}
+		w.Header().Set("ETag", makeETag(key, r.URL.Path, t))
+		s.setCacheControl(w, r, true)
+		if ct := s.ct.Get(r.URL.Path, contentTypeOf(c)); ct != "" {
+			w.Header().Set("Content-Type", ct)
+		}
+		cw := NewCountingResponseWriter(w)
+		_, ssp := s.tr.Start(r.Context(), "serve_content")
+		http.ServeContent(cw, r, "", *t, c)
+		ssp.SetAttributes(attribute.Int64("bytes", cw.bytes))
+		ssp.End()
+		s.st.Add(key, r.URL.Path, cw.bytes)
+		s.tp.Touch(key)
+	}))
+	if s.ap != 0 {
+		err = s.serveAdmin()
+		if err != nil {
+			return err
+		}
+	}
+	h := s.cors.Handler(compressHandler(enrichPlaylistHandler(mux, s.su)))
+	h = s.tr.Handler(h)
+	if s.al {
+		h = accessLogHandler(h)
+	}
+	if s.cert == "" {
+		log.Infof("serving Web at %v", addr)
+		return http.Serve(ln, h)
+	}
+	cr, err := newCertReloader(s.cert, s.key)
+	if err != nil {
+		return err
+	}
+	s.cr = cr
+	if s.rp != 0 {
+		err = s.serveRedirect()
+		if err != nil {
+			return err
+		}
+	}
+	srv := &http.Server{
+		Handler: h,
+		TLSConfig: &tls.Config{
+			GetCertificate: cr.GetCertificate,
+		},
+	}
+	log.Infof("serving Web with TLS at %v", addr)
+	return srv.ServeTLS(ln, "", "")
+}
+
+// serveAdmin serves metrics on separate listener, not exposed to clients
+func (s *Web) serveAdmin() error {
+	addr := fmt.Sprintf("%s:%d", s.ah, s.ap)
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return errors.Wrap(err, "failed to admin listen to tcp connection")
+	}
+	s.aln = ln
+	mux := http.NewServeMux()
+	mux.Handle("/debug/vars", expvar.Handler())
+	mux.HandleFunc("/stats/top", s.serveTop)
+	log.Infof("serving admin at %v", addr)
+	go http.Serve(ln, mux)
+	return nil
+}
+
+// serveTop responds with most popular keys or renditions
+func (s *Web) serveTop(w http.ResponseWriter, r *http.Request) {
+	n, _ := strconv.Atoi(r.URL.Query().Get("n"))
+	if n == 0 {
+		n = 10
+	}
+	window := time.Hour
+	if r.URL.Query().Get("window") != "" {
+		d, err := time.ParseDuration(r.URL.Query().Get("window"))
+		if err != nil {
+			writeAPIError(w, http.StatusBadRequest, &APIError{
+				Code:    ErrCodeInvalidRequest,
+				Message: "invalid window",
+			})
+			return
+		}
+		window = d
+	}
+	if window <= 0 || window > statsBucketSize*statsBuckets {
+		window = statsBucketSize * statsBuckets
+	}
+	by := statsByRequests
+	if r.URL.Query().Get("by") == statsByBytes {
+		by = statsByBytes
+	}
+	rendition := r.URL.Query().Get("group") == "rendition"
+	b, err := json.Marshal(s.st.Top(n, window, by, rendition))
+	if err != nil {
+		log.WithError(err).Error("failed to marshal stats")
+		writeServerError(w, "", err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(b)
+}
+
+// serveRedirect redirects plain HTTP requests to HTTPS listener
+func (s *Web) serveRedirect() error {
+	addr := fmt.Sprintf("%s:%d", s.host, s.rp)
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return errors.Wrap(err, "failed to redirect listen to tcp connection")
+	}
+	s.rln = ln
+	log.Infof("serving HTTPS redirect at %v", addr)
+	go http.Serve(ln, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host, _, err := net.SplitHostPort(r.Host)
+		if err != nil {
+			host = r.Host
+		}
+		u := *r.URL
+		u.Scheme = "https"
+		u.Host = net.JoinHostPort(host, strconv.Itoa(s.port))
+		if s.port == 443 {
+			u.Host = host
+		}
+		http.Redirect(w, r, u.String(), http.StatusMovedPermanently)
+	}))
+	return nil
 }
 
 func (s *Web) Close() {
 	if s.ln != nil {
 		s.ln.Close()
 	}
+	if s.rln != nil {
+		s.rln.Close()
+	}
+	if s.aln != nil {
+		s.aln.Close()
+	}
+	if s.cr != nil {
+		s.cr.Close()
+	}
 }